@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// interactive is set when standard output is a terminal, where repeated
+// lines can be counted in place.
+var interactive bool
+
+// useColor is set when console output should carry ANSI colour escapes.
+var useColor bool
+
+// severityColors are the colours events are printed in when their filter
+// has no OutputAttr, keyed by severity. The values are resolved escapes.
+var severityColors = map[string]string{
+	"info":     colorsMap["ANSI_COLOR_GREEN"],
+	"warning":  colorsMap["ANSI_COLOR_YELLOW"],
+	"alert":    colorsMap["ANSI_COLOR_RED"],
+	"critical": colorsMap["ANSI_COLOR_RED_BOLD"],
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// setupColor decides whether to use colour, given the -color mode. In auto
+// mode colour is used on a terminal unless NO_COLOR is set; an explicit
+// "always" wins over NO_COLOR.
+func setupColor(mode string) error {
+	interactive = isTerminal(os.Stdout)
+
+	switch mode {
+	case "auto":
+		useColor = interactive && len(os.Getenv("NO_COLOR")) == 0
+	case "always":
+		useColor = true
+	case "never":
+		useColor = false
+	default:
+		return fmt.Errorf("unknown color mode \"%s\" (expected auto, always or never)", mode)
+	}
+
+	return nil
+}
+
+// parseSeverityColors applies a -severity-colors list such as
+// "alert=ANSI_COLOR_MAGENTA,info=ANSI_COLOR_CYAN".
+func parseSeverityColors(spec string) error {
+
+	if len(spec) == 0 {
+		return nil
+	}
+
+	for _, item := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+
+		if len(parts) != 2 {
+			return fmt.Errorf("bad severity color \"%s\" (expected severity=color)", item)
+		}
+
+		attr, ok := colorsMap[parts[1]]
+
+		if !ok {
+			return fmt.Errorf("unknown color \"%s\" for severity %s", parts[1], parts[0])
+		}
+
+		severityColors[parts[0]] = attr
+	}
+
+	return nil
+}
+
+// colorize wraps text in a colour escape, if colour is in use.
+func colorize(attr, text string) string {
+
+	if !useColor || len(attr) == 0 {
+		return text
+	}
+
+	return attr + text + colorsMap["ANSI_COLOR_RESET"]
+}
+
+// eventColor is the colour a filter's events are printed in.
+func eventColor(fil *LogFilter) string {
+
+	if len(fil.OutputAttr) > 0 {
+		return fil.OutputAttr
+	}
+
+	return severityColors[fil.Severity]
+}
+
+// flushRepeats finishes off a run of identical console lines. On a terminal
+// the count has already been shown in place; elsewhere it is printed now, as
+// a line of its own.
+func flushRepeats() {
+
+	if lastRepeat > 0 {
+
+		if interactive {
+			fmt.Println("")
+		} else {
+			fmt.Println(colorize(colorsMap["ANSI_COLOR_GREEN"], fmt.Sprintf("--- Suppressed identical output line %d times.", lastRepeat)))
+		}
+
+	}
+
+	lastOutput = ""
+	lastRepeat = 0
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// readSourceFile reads one file of log source definitions.
+func readSourceFile(fname string) ([]LogAuditFile, error) {
+	var logs []LogAuditFile
+
+	if err := readConfigFile(fname, "LogAuditFile", "Sources", &logs); err != nil {
+		return nil, err
+	}
+
+	paths := make(map[string]bool)
+	names := make(map[string]bool)
+
+	for i := 0; i < len(logs); i++ {
+
+		if paths[logs[i].PathName] && len(logs[i].PathName) > 0 {
+			return nil, fmt.Errorf("log file %s is configured more than once in %s", logs[i].PathName, fname)
+		}
+
+		if names[logs[i].SourceName] && len(logs[i].SourceName) > 0 {
+			return nil, fmt.Errorf("log source %s is configured more than once in %s", logs[i].SourceName, fname)
+		}
+
+		paths[logs[i].PathName] = true
+		names[logs[i].SourceName] = true
+	}
+
+	return logs, nil
+}
+
+// findMergeTarget returns the source a drop-in entry adds to: the one with
+// the same PathName or, failing that, the same SourceName.
+func findMergeTarget(logs []LogAuditFile, entry *LogAuditFile) *LogAuditFile {
+
+	for i := 0; i < len(logs); i++ {
+
+		if len(entry.PathName) > 0 && logs[i].PathName == entry.PathName {
+			return &logs[i]
+		}
+
+	}
+
+	for i := 0; i < len(logs); i++ {
+
+		if len(entry.SourceName) > 0 && logs[i].SourceName == entry.SourceName {
+			return &logs[i]
+		}
+
+	}
+
+	return nil
+}
+
+// readSourceConfigs reads the main config file and then every config file
+// in the drop-in directory, in name order. The same rule holds within a file
+// and across files: a source is defined once, and a filter ID is used once.
+// A drop-in entry for a source that is already configured only extends it:
+// its filters are added, and settings the source does not have yet are
+// filled in, but settings it already has cannot be changed. Any other entry
+// is a new source.
+func readSourceConfigs(conffile, confdir string, debug bool) ([]LogAuditFile, error) {
+	logs, err := readSourceFile(conffile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	owners := make(map[string]string)
+	definedIn := make(map[string]string)
+
+	claimIDs := func(fname string, filters []LogFilter) error {
+
+		for _, fil := range filters {
+
+			if len(fil.ID) == 0 {
+				continue
+			}
+
+			if owner, ok := owners[fil.ID]; ok {
+
+				if owner == fname {
+					return fmt.Errorf("filter ID %s is used more than once in %s", fil.ID, fname)
+				}
+
+				return fmt.Errorf("filter ID %s is used in both %s and %s", fil.ID, owner, fname)
+			}
+
+			owners[fil.ID] = fname
+		}
+
+		return nil
+	}
+
+	for i := 0; i < len(logs); i++ {
+		definedIn[logs[i].PathName] = conffile
+
+		if err = claimIDs(conffile, logs[i].Filters); err != nil {
+			return nil, err
+		}
+
+	}
+
+	if len(confdir) == 0 {
+		return logs, nil
+	}
+
+	matches, err := filepath.Glob(filepath.Join(confdir, "*"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fname := range matches {
+
+		if !isConfigFile(fname) {
+			continue
+		}
+
+		entries, err := readSourceFile(fname)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if debug {
+			fmt.Fprintf(os.Stderr, "Merging %d log file entries from %s\n", len(entries), fname)
+		}
+
+		for i := 0; i < len(entries); i++ {
+			entry := &entries[i]
+
+			if err = claimIDs(fname, entry.Filters); err != nil {
+				return nil, err
+			}
+
+			target := findMergeTarget(logs, entry)
+
+			if target == nil {
+
+				if len(entry.PathName) == 0 {
+					return nil, fmt.Errorf("log source \"%s\" in %s has no PathName and matches no configured SourceName", entry.Description, fname)
+				}
+
+				definedIn[entry.PathName] = fname
+				logs = append(logs, *entry)
+				continue
+			}
+
+			if len(entry.PathName) > 0 && entry.PathName != target.PathName {
+				return nil, fmt.Errorf("log source %s in %s has PathName %s, but is configured with %s", entry.SourceName, fname, entry.PathName, target.PathName)
+			}
+
+			// The Description is only documentation, so a drop-in may
+			// describe its entry in its own words.
+			if len(target.Description) == 0 {
+				target.Description = entry.Description
+			}
+
+			for _, setting := range []struct {
+				name   string
+				target *string
+				val    string
+			}{
+				{"SourceName", &target.SourceName, entry.SourceName},
+				{"Format", &target.Format, entry.Format},
+				{"Timezone", &target.Timezone, entry.Timezone},
+				{"MaxSilence", &target.MaxSilence, entry.MaxSilence},
+			} {
+
+				if len(*setting.target) > 0 && len(setting.val) > 0 && *setting.target != setting.val {
+					return nil, fmt.Errorf("log file %s is configured in both %s and %s, with different %s settings", target.PathName, definedIn[target.PathName], fname, setting.name)
+				}
+
+				if len(*setting.target) == 0 {
+					*setting.target = setting.val
+				}
+
+			}
+
+			target.Filters = append(target.Filters, entry.Filters...)
+		}
+
+	}
+
+	return logs, nil
+}
+
+// dumpConfig prints the merged log source config, as it would look as a
+// single file.
+func dumpConfig(conffile, confdir string) error {
+	logs, err := readSourceConfigs(conffile, confdir, false)
+
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(logs, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(data))
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const baseSourceConfig = `[
+{ "Description": "tor daemon log", "SourceName": "tor", "PathName": "/var/log/tor/log", "Format": "raw",
+  "Filters": [ { "ID": "tor-warning", "Regexp": "warn (?P<w>.+)", "OutputStr": "{w}" } ] }
+]`
+
+// writeConfigs writes a main config and drop-ins, and returns the main
+// config file and the drop-in directory.
+func writeConfigs(t *testing.T, main string, dropins map[string]string) (string, string) {
+	dir := t.TempDir()
+	confdir := filepath.Join(dir, "sublogmon.d")
+
+	if err := os.Mkdir(confdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	conffile := filepath.Join(dir, "sublogmon.json")
+
+	if err := ioutil.WriteFile(conffile, []byte(main), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range dropins {
+
+		if err := ioutil.WriteFile(filepath.Join(confdir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+	}
+
+	return conffile, confdir
+}
+
+func TestDropinExtendsSource(t *testing.T) {
+	conffile, confdir := writeConfigs(t, baseSourceConfig, map[string]string{
+		"tor.json": `[ { "SourceName": "tor", "Description": "tor rules", "MaxSilence": "1h",
+		  "Filters": [ { "ID": "tor-bootstrap", "Regexp": "Bootstrapped (?P<pct>[0-9]+)%", "OutputStr": "{pct}" } ] } ]`,
+	})
+
+	logs, err := readSourceConfigs(conffile, confdir, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(logs) != 1 || len(logs[0].Filters) != 2 {
+		t.Fatalf("got %d sources, want 1 with 2 filters", len(logs))
+	}
+
+	if logs[0].MaxSilence != "1h" || logs[0].Description != "tor daemon log" {
+		t.Errorf("got MaxSilence %q and Description %q", logs[0].MaxSilence, logs[0].Description)
+	}
+
+}
+
+func TestUniquenessRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		main    string
+		dropins map[string]string
+		err     string
+	}{
+		{"filter ID twice in one file",
+			`[ { "SourceName": "a", "PathName": "/a", "Filters": [
+			     { "ID": "x", "Regexp": "a", "OutputStr": "a" },
+			     { "ID": "x", "Regexp": "b", "OutputStr": "b" } ] } ]`,
+			nil, "used more than once"},
+		{"filter ID in two sources of one file",
+			`[ { "SourceName": "a", "PathName": "/a", "Filters": [ { "ID": "x", "Regexp": "a", "OutputStr": "a" } ] },
+			   { "SourceName": "b", "PathName": "/b", "Filters": [ { "ID": "x", "Regexp": "b", "OutputStr": "b" } ] } ]`,
+			nil, "used more than once"},
+		{"filter ID in two files",
+			baseSourceConfig,
+			map[string]string{"x.json": `[ { "SourceName": "tor", "Filters": [ { "ID": "tor-warning", "Regexp": "b", "OutputStr": "b" } ] } ]`},
+			"used in both"},
+		{"PathName twice in one file",
+			`[ { "SourceName": "a", "PathName": "/a" }, { "SourceName": "b", "PathName": "/a" } ]`,
+			nil, "configured more than once"},
+		{"SourceName twice in one file",
+			`[ { "SourceName": "a", "PathName": "/a" }, { "SourceName": "a", "PathName": "/b" } ]`,
+			nil, "configured more than once"},
+		{"drop-in redefining a source",
+			baseSourceConfig,
+			map[string]string{"x.json": `[ { "PathName": "/var/log/tor/log", "Format": "rfc3164" } ]`},
+			"different Format"},
+		{"drop-in moving a source",
+			baseSourceConfig,
+			map[string]string{"x.json": `[ { "SourceName": "tor", "PathName": "/var/log/tor/other" } ]`},
+			"is configured with"},
+	}
+
+	for _, test := range tests {
+		conffile, confdir := writeConfigs(t, test.main, test.dropins)
+		_, err := readSourceConfigs(conffile, confdir, false)
+
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want one saying %q", test.name, err, test.err)
+		}
+
+	}
+
+}
+
+// The shipped config follows the rule too; its two oz-daemon-fatal filters
+// were folded into one that matches both forms of the line.
+func TestShippedConfigUnique(t *testing.T) {
+
+	if _, err := readSourceConfigs("sublogmon.json", "", false); err != nil {
+		t.Fatal(err)
+	}
+
+	logs, _, err := loadConfig("sublogmon.json", "", "", false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := findSource(t, logs, "oz-daemon")
+
+	for _, line := range []string{
+		"Mar  8 22:09:55 subgraph oz-daemon[1234]: [firefox] (mount) [FATAL] cannot bind /home",
+		"Mar  8 22:09:55 subgraph oz-daemon: [1234] [firefox] (mount) [FATAL] cannot bind /home",
+	} {
+		events := runLines(src, line)
+
+		if len(events) != 1 || events[0].Metadata["application"] != "firefox" || events[0].Metadata["errmsg"] != "cannot bind /home" {
+			t.Errorf("%s: got %d events", line, len(events))
+		}
+
+	}
+
+}
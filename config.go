@@ -0,0 +1,388 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	inotify "github.com/subgraph/inotify"
+)
+
+// loadConfig reads the log source configs, including drop-ins, and the
+// suppression config and compiles every regexp in them. No global state is
+// touched, so a config that fails to load can simply be thrown away.
+func loadConfig(conffile, confdir, supfile string, debug bool) ([]LogAuditFile, []LogSuppression, error) {
+	var sups []LogSuppression
+
+	logs, err := readSourceConfigs(conffile, confdir, debug)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, err = os.Stat(supfile); err != nil {
+		fmt.Println("Warning: no suppressions file was found!")
+	} else {
+
+		err = readConfigFile(supfile, "LogSuppression", "Suppressions", &sups)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if debug {
+			fmt.Fprintf(os.Stderr, "Read a total of %d suppressions from config\n", len(sups))
+		}
+
+	}
+
+	if debug {
+		fmt.Fprintf(os.Stderr, "There are %d log file entries\n", len(logs))
+	}
+
+	for i := 0; i < len(logs); i++ {
+
+		if len(logs[i].PathName) == 0 {
+			return nil, nil, fmt.Errorf("log source \"%s\" has no PathName", logs[i].Description)
+		}
+
+		if len(logs[i].MaxSilence) > 0 {
+			logs[i].maxSilence, err = time.ParseDuration(logs[i].MaxSilence)
+
+			if err != nil || logs[i].maxSilence <= 0 {
+				return nil, nil, fmt.Errorf("log source \"%s\" has a bad MaxSilence \"%s\"", logs[i].Description, logs[i].MaxSilence)
+			}
+
+		}
+
+		if err = setupFormat(&logs[i]); err != nil {
+			return nil, nil, err
+		}
+
+		logs[i].lastLine = time.Now()
+
+		if debug {
+			fmt.Fprintf(os.Stderr, "{%d} Description = |%s|, Pathname = |%s| -> %d filters\n", i, logs[i].Description, logs[i].PathName, len(logs[i].Filters))
+		}
+
+		for j := 0; j < len(logs[i].Filters); j++ {
+			fil := &(logs[i].Filters[j])
+			outStr := "*" + fil.OutputAttr + "*"
+
+			if len(fil.OutputAttr) > 0 {
+				attr, ok := colorsMap[fil.OutputAttr]
+
+				if !ok {
+					return nil, nil, fmt.Errorf("filter %s uses unknown OutputAttr \"%s\"", fil.ID, fil.OutputAttr)
+				}
+
+				fil.OutputAttr = attr
+			}
+
+			if err = setupParser(fil); err != nil {
+				return nil, nil, fmt.Errorf("filter %s: %v", fil.ID, err)
+			}
+
+			fil.Regcomp = nil
+
+			if len(fil.Regexp) > 0 {
+				fil.Regcomp, err = regexp.Compile(fil.Regexp)
+
+				if err != nil {
+					return nil, nil, fmt.Errorf("filter %s has a bad regexp: %v", fil.ID, err)
+				}
+
+			}
+
+			if err = setupFieldTypes(fil, &logs[i]); err != nil {
+				return nil, nil, fmt.Errorf("filter %s: %v", fil.ID, err)
+			}
+
+			if err = setupExec(fil); err != nil {
+				return nil, nil, fmt.Errorf("filter %s: %v", fil.ID, err)
+			}
+
+			for _, name := range fil.Enrich {
+				fn := findEnricher(name)
+
+				if fn == nil {
+					return nil, nil, fmt.Errorf("filter %s asks for unknown enrichment \"%s\"", fil.ID, name)
+				}
+
+				fil.enrichers = append(fil.enrichers, fn)
+			}
+
+			if debug {
+				fmt.Fprintf(os.Stderr, "   [%d] Regexp = %s\n", j+1, fil.Regexp)
+				fmt.Fprintf(os.Stderr, "   [%d] nfields = %d : %v\n", j+1, len(fil.Fields), fil.Fields)
+				fmt.Fprintf(os.Stderr, "   [%d] OutputStr = %s, OutputAttr = %s\n", j+1, fil.OutputStr, outStr)
+			}
+
+		}
+
+		setupPrefilters(&logs[i])
+
+		if debug {
+
+			for j := 0; j < len(logs[i].Filters); j++ {
+				fmt.Fprintf(os.Stderr, "   [%d] Contains = %q\n", j+1, logs[i].Filters[j].Contains)
+			}
+
+			fmt.Fprintf(os.Stderr, "   combined prefilter: %v\n", logs[i].prefilter != nil)
+		}
+
+	}
+
+	for i := 0; i < len(sups); i++ {
+
+		if len(sups[i].Wildcard) > 0 {
+			sups[i].Regcomp, err = regexp.Compile(sups[i].Wildcard)
+
+			if err != nil {
+				return nil, nil, fmt.Errorf("suppression \"%s\" has a bad wildcard: %v", sups[i].Description, err)
+			}
+
+		}
+
+		sups[i].MetaRegcomp = make(map[string]*regexp.Regexp)
+
+		for key, val := range sups[i].Metadata {
+			sups[i].MetaRegcomp[key], err = regexp.Compile(val)
+
+			if err != nil {
+				return nil, nil, fmt.Errorf("suppression \"%s\" has a bad metadata pattern for %s: %v", sups[i].Description, key, err)
+			}
+
+		}
+
+	}
+
+	return logs, sups, nil
+}
+
+// openLogFile opens a monitored log file and skips to its end so that only
+// newly written lines are picked up.
+func openLogFile(pathname string) (*os.File, error) {
+	f, err := os.OpenFile(pathname, os.O_RDONLY, 0666)
+
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not call stat on log file: %v", err)
+	}
+
+	ret, err := f.Seek(0, os.SEEK_END)
+
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("unexpected problem occurred while attempting to skip to end of log file: %v", err)
+	}
+
+	if ret != fi.Size() {
+		f.Close()
+		return nil, fmt.Errorf("unexpected problem occurred when attempting to skip to end of log file")
+	}
+
+	return f, nil
+}
+
+// openSource starts following every file that currently belongs to a log
+// source and is not followed yet. Either all of them are opened or none are.
+func openSource(watcher *inotify.Watcher, src *LogAuditFile, atEnd bool, debug bool) error {
+	var added []string
+
+	files, err := sourceFiles(src)
+
+	if err != nil {
+		return err
+	}
+
+	if debug {
+		fmt.Println("Adding inotify watcher for service:", src.Description)
+	}
+
+	for _, fname := range files {
+
+		if _, ok := src.tails[fname]; ok {
+			continue
+		}
+
+		err = addTail(watcher, src, fname, atEnd)
+
+		if err != nil {
+
+			for _, pathname := range added {
+				removeTail(watcher, src, pathname)
+			}
+
+			return err
+		}
+
+		added = append(added, fname)
+	}
+
+	return nil
+}
+
+// closeSource stops following all of a log source's files.
+func closeSource(watcher *inotify.Watcher, src *LogAuditFile) {
+
+	for pathname := range src.tails {
+		removeTail(watcher, src, pathname)
+	}
+
+}
+
+// logParentDirs returns the set of directories containing the given log
+// sources; these are watched so that rotations and newly created files can
+// be noticed.
+func logParentDirs(logs []LogAuditFile) map[string]bool {
+	dirs := make(map[string]bool)
+
+	for i := 0; i < len(logs); i++ {
+
+		for _, dname := range sourceDirs(&logs[i]) {
+			dirs[dname] = true
+		}
+
+	}
+
+	return dirs
+}
+
+// reloadConfig loads the configuration again and swaps it in place of the
+// running one. Sources whose PathName did not change keep their open files,
+// read offsets, Backlogs and status. Files of sources that disappeared are
+// handed over, as they are, to a new source covering them, so that a changed
+// PathName does not lose its place in a file; the remaining files of removed
+// sources are closed before new sources are started. If the new configuration
+// is invalid the running one is left untouched.
+func reloadConfig(watcher *inotify.Watcher, parentDirs map[string]bool, conffile, confdir, supfile string, debug bool) error {
+	logs, sups, err := loadConfig(conffile, confdir, supfile, debug)
+
+	if err != nil {
+		return err
+	}
+
+	old := make(map[string]*LogAuditFile)
+
+	for i := 0; i < len(AuditLogs); i++ {
+		old[AuditLogs[i].PathName] = &AuditLogs[i]
+	}
+
+	kept := make([]bool, len(logs))
+
+	for i := 0; i < len(logs); i++ {
+
+		if o, ok := old[logs[i].PathName]; ok {
+			logs[i].tails = o.tails
+			logs[i].lost = o.lost
+			logs[i].status = o.status
+			logs[i].retryAt = o.retryAt
+			logs[i].retryDelay = o.retryDelay
+			logs[i].announced = o.announced
+			logs[i].rotatedAt = o.rotatedAt
+			logs[i].lastLine = o.lastLine
+			logs[i].silent = o.silent
+			delete(old, logs[i].PathName)
+			kept[i] = true
+		}
+
+	}
+
+	for i := 0; i < len(logs); i++ {
+
+		if kept[i] {
+			continue
+		}
+
+		for _, o := range old {
+
+			for pathname, tail := range o.tails {
+
+				if _, ok := logs[i].tails[pathname]; ok || !matchesSource(&logs[i], pathname) {
+					continue
+				}
+
+				if logs[i].tails == nil {
+					logs[i].tails = make(map[string]*logTail)
+				}
+
+				logs[i].tails[pathname] = tail
+				delete(o.tails, pathname)
+			}
+
+		}
+
+	}
+
+	for pathname, o := range old {
+
+		if debug {
+			fmt.Println("No longer monitoring:", pathname)
+		}
+
+		closeSource(watcher, o)
+	}
+
+	for i := 0; i < len(logs); i++ {
+
+		if !kept[i] {
+			startSource(watcher, &logs[i], true, debug)
+		}
+
+	}
+
+	newDirs := logParentDirs(logs)
+
+	for dname := range parentDirs {
+
+		if !newDirs[dname] {
+			watcher.RemoveWatch(dname)
+			delete(parentDirs, dname)
+		}
+
+	}
+
+	watchDirs(watcher, parentDirs, logs, debug)
+
+	AuditLogs = logs
+	Suppressions = sups
+	return nil
+}
+
+// watchConfigFiles sets up an inotify watcher on the directories holding the
+// config files. Directories rather than the files themselves are watched since
+// most editors save by writing a new file and renaming it into place.
+func watchConfigFiles(files ...string) (*inotify.Watcher, error) {
+	watcher, err := inotify.NewWatcher()
+
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := make(map[string]bool)
+
+	for _, fname := range files {
+		dirs[filepath.Dir(fname)] = true
+	}
+
+	for dname := range dirs {
+		err = watcher.AddWatch(dname, inotify.IN_CLOSE_WRITE|inotify.IN_MOVED_TO)
+
+		if err != nil {
+			watcher.Close()
+			return nil, err
+		}
+
+	}
+
+	return watcher, nil
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// configSchema is the JSON Schema of the config files. It is shipped as
+// sublogmon.schema.json for editors, and every config file is checked
+// against it before it is decoded.
+//
+//go:embed sublogmon.schema.json
+var configSchema []byte
+
+// CONFIG_EXTENSIONS are the config file formats understood, by extension.
+var CONFIG_EXTENSIONS = []string{".json", ".yaml", ".yml", ".toml"}
+
+// isConfigFile reports whether a file name has a config file extension.
+func isConfigFile(fname string) bool {
+	ext := filepath.Ext(fname)
+
+	for _, cext := range CONFIG_EXTENSIONS {
+
+		if ext == cext {
+			return true
+		}
+
+	}
+
+	return false
+}
+
+// readConfigFile decodes a config file in any of the supported formats,
+// validates it against the schema definition named by def and stores the
+// list it holds in v. A TOML file cannot hold a bare list, so there the
+// list is the array of tables named by tomlKey ([[Sources]] or
+// [[Suppressions]]).
+func readConfigFile(fname, def, tomlKey string, v interface{}) error {
+	data, err := ioutil.ReadFile(fname)
+
+	if err != nil {
+		return err
+	}
+
+	return decodeConfig(fname, data, def, tomlKey, v)
+}
+
+// decodeConfig does the work of readConfigFile on data already read; the
+// format is still taken from the extension of fname.
+func decodeConfig(fname string, data []byte, def, tomlKey string, v interface{}) error {
+	var doc interface{}
+	var err error
+
+	switch filepath.Ext(fname) {
+	case ".yaml", ".yml":
+		var ydoc interface{}
+
+		if err = yaml.Unmarshal(data, &ydoc); err != nil {
+			return fmt.Errorf("error decoding yaml data from %s: %v", fname, err)
+		}
+
+		doc = fromYAML(ydoc)
+	case ".toml":
+		var tdoc map[string]interface{}
+
+		if _, err = toml.Decode(string(data), &tdoc); err != nil {
+			return fmt.Errorf("error decoding toml data from %s: %v", fname, err)
+		}
+
+		for key := range tdoc {
+
+			if key != tomlKey {
+				return fmt.Errorf("%s: unexpected table \"%s\" (expected [[%s]])", fname, key, tomlKey)
+			}
+
+		}
+
+		if list, ok := tdoc[tomlKey]; ok {
+			doc = list
+		} else {
+			doc = []interface{}{}
+		}
+
+	default:
+
+		if err = json.Unmarshal(data, &doc); err != nil {
+			return fmt.Errorf("error decoding json data from %s: %v", fname, err)
+		}
+
+	}
+
+	// An empty YAML file is an empty list.
+	if doc == nil {
+		doc = []interface{}{}
+	}
+
+	// From here on every format is handled the same way.
+	data, err = json.Marshal(doc)
+
+	if err != nil {
+		return fmt.Errorf("%s: %v", fname, err)
+	}
+
+	doc = nil
+
+	if err = json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+
+	if err = validateConfig(doc, def); err != nil {
+		return fmt.Errorf("%s: %v", fname, err)
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// fromYAML turns the map[interface{}]interface{} that the YAML decoder
+// produces into the map[string]interface{} that JSON needs.
+func fromYAML(node interface{}) interface{} {
+
+	switch n := node.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{})
+
+		for key, val := range n {
+			m[fmt.Sprint(key)] = fromYAML(val)
+		}
+
+		return m
+	case []interface{}:
+
+		for i := range n {
+			n[i] = fromYAML(n[i])
+		}
+
+	}
+
+	return node
+}
+
+// schemaNode is the part of JSON Schema that the validator understands.
+type schemaNode struct {
+	Ref                  string                 `json:"$ref"`
+	Type                 string                 `json:"type"`
+	Properties           map[string]*schemaNode `json:"properties"`
+	AdditionalProperties json.RawMessage        `json:"additionalProperties"`
+	Required             []string               `json:"required"`
+	Items                *schemaNode            `json:"items"`
+	Enum                 []interface{}          `json:"enum"`
+	MinLength            int                    `json:"minLength"`
+	Pattern              string                 `json:"pattern"`
+	AnyOf                []*schemaNode          `json:"anyOf"`
+	Definitions          map[string]*schemaNode `json:"definitions"`
+}
+
+var schemaRoot *schemaNode
+
+// validateConfig checks a decoded config file, which must be a list, against
+// the schema definition def. Property names are matched the way
+// encoding/json matches them to struct fields, without regard to case.
+func validateConfig(doc interface{}, def string) error {
+
+	if schemaRoot == nil {
+		var root schemaNode
+
+		if err := json.Unmarshal(configSchema, &root); err != nil {
+			return fmt.Errorf("bad built-in schema: %v", err)
+		}
+
+		schemaRoot = &root
+	}
+
+	list := &schemaNode{Type: "array", Items: &schemaNode{Ref: "#/definitions/" + def}}
+	return list.validate(doc, "")
+}
+
+func (sn *schemaNode) resolve() *schemaNode {
+
+	if strings.HasPrefix(sn.Ref, "#/definitions/") {
+
+		if def, ok := schemaRoot.Definitions[strings.TrimPrefix(sn.Ref, "#/definitions/")]; ok {
+			return def
+		}
+
+	}
+
+	return sn
+}
+
+func jsonType(val interface{}) string {
+
+	switch v := val.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+
+		if v == float64(int64(v)) {
+			return "integer"
+		}
+
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+
+	return "unknown"
+}
+
+func (sn *schemaNode) validate(val interface{}, path string) error {
+	sn = sn.resolve()
+
+	if len(path) == 0 {
+		path = "top level"
+	}
+
+	if len(sn.Type) > 0 {
+		vtype := jsonType(val)
+
+		if vtype != sn.Type && !(sn.Type == "number" && vtype == "integer") {
+			return fmt.Errorf("%s: expected %s, not %s", path, sn.Type, vtype)
+		}
+
+	}
+
+	if len(sn.Enum) > 0 {
+		found := false
+
+		for _, allowed := range sn.Enum {
+
+			if allowed == val {
+				found = true
+				break
+			}
+
+		}
+
+		if !found {
+			return fmt.Errorf("%s: %v is not one of %v", path, val, sn.Enum)
+		}
+
+	}
+
+	if s, ok := val.(string); ok {
+
+		if len([]rune(s)) < sn.MinLength {
+			return fmt.Errorf("%s: must not be empty", path)
+		}
+
+		if len(sn.Pattern) > 0 {
+			re, err := regexp.Compile(sn.Pattern)
+
+			if err == nil && !re.MatchString(s) {
+				return fmt.Errorf("%s: \"%s\" is not valid here", path, s)
+			}
+
+		}
+
+	}
+
+	if list, ok := val.([]interface{}); ok && sn.Items != nil {
+
+		for i, item := range list {
+
+			if err := sn.Items.validate(item, fmt.Sprintf("%s[%d]", strings.TrimPrefix(path, "top level"), i)); err != nil {
+				return err
+			}
+
+		}
+
+	}
+
+	if obj, ok := val.(map[string]interface{}); ok {
+
+		if err := sn.validateObject(obj, path); err != nil {
+			return err
+		}
+
+	}
+
+	if len(sn.AnyOf) > 0 {
+		var first error
+
+		for _, alt := range sn.AnyOf {
+			err := alt.validate(val, path)
+
+			if err == nil {
+				return nil
+			}
+
+			if first == nil {
+				first = err
+			}
+
+		}
+
+		return first
+	}
+
+	return nil
+}
+
+func (sn *schemaNode) findProperty(key string) (string, *schemaNode) {
+
+	for name, prop := range sn.Properties {
+
+		if strings.EqualFold(name, key) {
+			return name, prop
+		}
+
+	}
+
+	return "", nil
+}
+
+func (sn *schemaNode) validateObject(obj map[string]interface{}, path string) error {
+	keys := make([]string, 0, len(obj))
+
+	for key := range obj {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		name, prop := sn.findProperty(key)
+
+		if prop != nil {
+
+			if err := prop.validate(obj[key], path+"."+name); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if string(sn.AdditionalProperties) == "false" {
+			return fmt.Errorf("%s: unknown setting \"%s\"", path, key)
+		}
+
+		if len(sn.AdditionalProperties) > 0 && string(sn.AdditionalProperties) != "true" {
+			var extra schemaNode
+
+			if json.Unmarshal(sn.AdditionalProperties, &extra) == nil {
+
+				if err := extra.validate(obj[key], path+"."+key); err != nil {
+					return err
+				}
+
+			}
+
+		}
+
+	}
+
+	for _, name := range sn.Required {
+		found := false
+
+		for key := range obj {
+
+			if strings.EqualFold(name, key) {
+				found = true
+				break
+			}
+
+		}
+
+		if !found {
+			return fmt.Errorf("%s: %s is required", path, name)
+		}
+
+	}
+
+	return nil
+}
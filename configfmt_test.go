@@ -0,0 +1,139 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The same sources written in each config format.
+var sourceConfigs = map[string]string{
+	"sources.json": `[
+{ "SourceName": "auth", "PathName": "/var/log/auth.log", "Format": "rfc3164", "MaxSilence": "1h",
+  "Filters": [
+    { "ID": "ssh-fail", "Regexp": "Failed password for (?P<user>\\S+)", "OutputStr": "{user}",
+      "Fields": ["port:int"], "Conditions": ["port != 22"], "Match": {"program": "sshd"},
+      "Severity": "alert", "Continue": true, "Tags": ["ssh"],
+      "Exec": { "Argv": ["/usr/local/bin/block", "{user}"], "Limit": 2, "Per": "10m" } }
+  ] }
+]`,
+	"sources.yaml": `
+- SourceName: auth
+  PathName: /var/log/auth.log
+  Format: rfc3164
+  MaxSilence: 1h
+  Filters:
+    - ID: ssh-fail
+      Regexp: 'Failed password for (?P<user>\S+)'
+      OutputStr: '{user}'
+      Fields: ["port:int"]
+      Conditions: ["port != 22"]
+      Match: {program: sshd}
+      Severity: alert
+      Continue: true
+      Tags: [ssh]
+      Exec:
+        Argv: [/usr/local/bin/block, '{user}']
+        Limit: 2
+        Per: 10m
+`,
+	"sources.toml": `
+[[Sources]]
+SourceName = "auth"
+PathName = "/var/log/auth.log"
+Format = "rfc3164"
+MaxSilence = "1h"
+
+[[Sources.Filters]]
+ID = "ssh-fail"
+Regexp = 'Failed password for (?P<user>\S+)'
+OutputStr = "{user}"
+Fields = ["port:int"]
+Conditions = ["port != 22"]
+Match = { program = "sshd" }
+Severity = "alert"
+Continue = true
+Tags = ["ssh"]
+Exec = { Argv = ["/usr/local/bin/block", "{user}"], Limit = 2, Per = "10m" }
+`,
+}
+
+func TestConfigFormatsAgree(t *testing.T) {
+	var want []LogAuditFile
+
+	if err := decodeConfig("sources.json", []byte(sourceConfigs["sources.json"]), "LogAuditFile", "Sources", &want); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(want) != 1 || len(want[0].Filters) != 1 || want[0].Filters[0].Exec == nil || want[0].Filters[0].Exec.Limit != 2 {
+		t.Fatalf("got %+v", want)
+	}
+
+	for fname, data := range sourceConfigs {
+		var logs []LogAuditFile
+
+		if err := decodeConfig(fname, []byte(data), "LogAuditFile", "Sources", &logs); err != nil {
+			t.Errorf("%s: %v", fname, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(logs, want) {
+			t.Errorf("%s: got %+v, want %+v", fname, logs, want)
+		}
+
+	}
+
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		fname string
+		data  string
+		err   string
+	}{
+		{"a.json", `[ { "sourcename": "a", "pathname": "/a" } ]`, ""},
+		{"a.json", `{ "SourceName": "a" }`, "top level: expected array, not object"},
+		{"a.json", `[ { "SourceName": "a", "Path": "/a" } ]`, `[0]: unknown setting "Path"`},
+		{"a.json", `[ { "Description": "no name or path" } ]`, `[0]: `},
+		{"a.json", `[ { "SourceName": "a", "MaxSilence": 60 } ]`, "[0].MaxSilence: expected string, not integer"},
+		{"a.json", `[ { "SourceName": "a", "MaxSilence": "an hour" } ]`, `[0].MaxSilence: "an hour" is not valid here`},
+		{"a.json", `[ { "SourceName": "a", "Format": "csv" } ]`, "[0].Format: csv is not one of"},
+		{"a.json", `[ { "SourceName": "a", "Filters": [ { "ID": "x", "Continue": "yes" } ] } ]`,
+			"[0].Filters[0].Continue: expected boolean, not string"},
+		{"a.json", `[ { "SourceName": "a", "Filters": [ { "ID": "x", "Regexp": "x" }, { "ID": "y", "Exec": { "Argv": "/bin/true" } } ] } ]`,
+			"[0].Filters[1].Exec.Argv: expected array, not string"},
+		{"a.json", `[ { "SourceName": "a", "Filters": [ { "ID": "x", "Exec": { "Argv": ["/bin/true"], "Shell": true } } ] } ]`,
+			`[0].Filters[0].Exec: unknown setting "Shell"`},
+		{"a.json", `[ { "SourceName": "a", "Filters": [ { "ID": "x", "Exec": { "Timeout": "1s" } } ] } ]`,
+			"[0].Filters[0].Exec: "},
+		{"a.json", `[ { "SourceName": "a", "Filters": [ { "ID": "x", "Exec": { "Argv": ["/bin/true"], "Limit": 1.5 } } ] } ]`,
+			"[0].Filters[0].Exec.Limit: expected integer, not number"},
+		{"a.yaml", "- SourceName: a\n  Filters:\n    - ID: x\n      Exec: {Argv: [/bin/true], Shell: true}\n",
+			`[0].Filters[0].Exec: unknown setting "Shell"`},
+		{"a.yaml", "- SourceName: a\n  MaxSilence: 60\n", "[0].MaxSilence: expected string, not integer"},
+		{"a.toml", "[[Sources]]\nSourceName = \"a\"\n[[Sources.Filters]]\nID = \"x\"\nExec = { Argv = \"/bin/true\" }\n",
+			"[0].Filters[0].Exec.Argv: expected array, not string"},
+		{"a.toml", "[[Sources]]\nSourceName = \"a\"\nPath = \"/a\"\n", `[0]: unknown setting "Path"`},
+		{"a.toml", "[[Suppressions]]\nOutputStr = \"a\"\n", `unexpected table "Suppressions"`},
+	}
+
+	for _, test := range tests {
+		var logs []LogAuditFile
+		err := decodeConfig(test.fname, []byte(test.data), "LogAuditFile", "Sources", &logs)
+
+		if len(test.err) == 0 {
+
+			if err != nil {
+				t.Errorf("%s %q: %v", test.fname, test.data, err)
+			}
+
+			continue
+		}
+
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s %q: got error %v, want %q", test.fname, test.data, err, test.err)
+		}
+
+	}
+
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 //	"fmt"
+	"time"
+
         "github.com/godbus/dbus"
 )
 
@@ -16,6 +18,22 @@ type slmData struct {
 	LogLine string
 	OrigLogLine string
 	Metadata map[string]string
+	ObservedTimestamp int64
+}
+
+// SLM_DBUS_PATH and SLM_DBUS_INTERFACE are what sublogmon's own signals are
+// sent from, so that they cannot be mistaken for events.
+const SLM_DBUS_PATH = "/com/subgraph/sublogmon"
+const SLM_DBUS_INTERFACE = "com.subgraph.sublogmon"
+
+// dbusAlert is the form of slmData the event notifier's Alert method takes.
+type dbusAlert struct {
+	EventID string
+	LogLevel string
+	Timestamp int64
+	LogLine string
+	OrigLogLine string
+	Metadata map[string]string
 }
 
 func newDbusObject() (*dbusObject, error) {
@@ -25,12 +43,62 @@ func newDbusObject() (*dbusObject, error) {
                 return nil, err
         }
 
-        return &dbusObject{conn.Object("com.subgraph.EventNotifier", "/com/subgraph/EventNotifier")}, nil
+        return &dbusObject{conn.Object(EVENT_NOTIFIER_NAME, "/com/subgraph/EventNotifier")}, nil
 }
 
-func (ob *dbusObject) alertObj(id, level string, timestamp int64, line, oline string, metadata map[string]string) {
+func (ob *dbusObject) alertObj(id, level string, timestamp int64, line, oline string, metadata map[string]string) error {
 //	fmt.Println("id = ", id)
 //	fmt.Println("xyz: ", line)
-	dobj := slmData{id, level, timestamp, line, oline, metadata}
-        ob.Call("com.subgraph.EventNotifier.Alert", 0, dobj)
+	dobj := dbusAlert{id, level, timestamp, line, oline, metadata}
+        return ob.Call("com.subgraph.EventNotifier.Alert", 0, dobj).Err
+}
+
+func (ob *dbusObject) Name() string {
+	return "D-Bus event notifier"
+}
+
+// emitHeartbeat broadcasts a Heartbeat signal on the system bus, whether or
+// not the event notifier is there, rather than calling its Alert method, so
+// that it is never shown as an event. Tests replace it to catch heartbeats.
+var emitHeartbeat = func(metadata map[string]string) error {
+	conn, err := dbus.SystemBus()
+
+	if err != nil {
+		return err
+	}
+
+	return conn.Emit(SLM_DBUS_PATH, SLM_DBUS_INTERFACE+".Heartbeat", metadata)
+}
+
+// Send delivers the long form of an event; a separate short title, if the
+// filter has one, is passed along in the "title" metadata key, and the time
+// the line was read, if it is not the time of the event, in "observed".
+func (ob *dbusObject) Send(ev *logEvent) error {
+	metadata := ev.Metadata
+	observed := ev.ObservedTimestamp != ev.Timestamp
+
+	if ev.Title != ev.LogLine || observed {
+		metadata = make(map[string]string)
+
+		for key, val := range ev.Metadata {
+			metadata[key] = val
+		}
+
+		if ev.Title != ev.LogLine {
+			metadata["title"] = ev.Title
+		}
+
+		if observed {
+			metadata["observed"] = time.Unix(0, ev.ObservedTimestamp).Format(time.RFC3339Nano)
+		}
+
+	}
+
+	err := ob.alertObj(ev.EventID, ev.LogLevel, ev.Timestamp, ev.LogLine, ev.OrigLogLine, metadata)
+
+	if err != nil {
+		metrics.countDbusFailure()
+	}
+
+	return err
 }
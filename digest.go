@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DEFAULT_SENDMAIL = "/usr/sbin/sendmail"
+
+// DIGEST_TOP is how many applications and hosts a digest lists, and
+// DIGEST_RECENT how many of the latest events it shows in full.
+const DIGEST_TOP = 5
+const DIGEST_RECENT = 20
+
+// The metadata keys that name the application or the remote host of an
+// event, in order of preference.
+var appKeys = []string{"application", "app", "exename", "exe", "comm", "process", "program"}
+var hostKeys = []string{"host", "ip", "hostname", "addr", "saddr", "daddr"}
+
+// mailer sends mail through a local sendmail binary or, if relay is set, an
+// SMTP relay.
+type mailer struct {
+	from     string
+	to       []string
+	relay    string
+	sendmail string
+}
+
+// send mails a plain text message. It is written with bare newlines, as
+// sendmail expects; the SMTP client turns them into CRLF.
+func (m *mailer) send(subject, body string) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\n", m.from)
+	fmt.Fprintf(&msg, "To: %s\n", strings.Join(m.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\n")
+	msg.WriteString("Content-Transfer-Encoding: 8bit\n\n")
+	msg.WriteString(body)
+
+	if len(m.relay) > 0 {
+		return smtp.SendMail(m.relay, nil, m.from, m.to, msg.Bytes())
+	}
+
+	cmd := exec.Command(m.sendmail, "-t", "-i", "-f", m.from)
+	cmd.Stdin = &msg
+	out, err := cmd.CombinedOutput()
+
+	if err != nil && len(out) > 0 {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	return err
+}
+
+// digestEntry counts the events of one ID and severity in a digest.
+type digestEntry struct {
+	id       string
+	severity string
+	count    int
+}
+
+// digestSink collects events and mails a summary of them every interval,
+// and critical events at once if immediate is set. A digest is only sent if
+// there was something to report.
+type digestSink struct {
+	sync.Mutex
+	mail      *mailer
+	hostname  string
+	immediate bool
+	start     time.Time
+	entries   map[string]*digestEntry
+	apps      map[string]int
+	hosts     map[string]int
+	recent    []*logEvent
+	total     int
+}
+
+func newDigestSink(mail *mailer, interval time.Duration, immediate bool) *digestSink {
+	hostname, _ := os.Hostname()
+	ds := &digestSink{mail: mail, hostname: hostname, immediate: immediate}
+	ds.reset(time.Now())
+
+	go func() {
+
+		for range time.Tick(interval) {
+
+			if err := ds.Flush(); err != nil {
+				fmt.Println("Error sending the event digest: ", err)
+			}
+
+		}
+
+	}()
+
+	return ds
+}
+
+func (ds *digestSink) reset(now time.Time) {
+	ds.start = now
+	ds.entries = make(map[string]*digestEntry)
+	ds.apps = make(map[string]int)
+	ds.hosts = make(map[string]int)
+	ds.recent = nil
+	ds.total = 0
+}
+
+func (ds *digestSink) Name() string {
+	return "email digest"
+}
+
+// firstValue returns the value of the first of keys an event has.
+func firstValue(metadata map[string]string, keys []string) string {
+
+	for _, key := range keys {
+
+		if val := metadata[key]; len(val) > 0 {
+			return val
+		}
+
+	}
+
+	return ""
+}
+
+func (ds *digestSink) Send(ev *logEvent) error {
+	ds.Lock()
+	key := ev.EventID + "\x00" + ev.LogLevel
+	entry, ok := ds.entries[key]
+
+	if !ok {
+		entry = &digestEntry{id: ev.EventID, severity: ev.LogLevel}
+		ds.entries[key] = entry
+	}
+
+	entry.count++
+	ds.total++
+
+	if app := firstValue(ev.Metadata, appKeys); len(app) > 0 {
+		ds.apps[app]++
+	}
+
+	if host := firstValue(ev.Metadata, hostKeys); len(host) > 0 {
+		ds.hosts[host]++
+	}
+
+	ds.recent = append(ds.recent, ev)
+
+	if len(ds.recent) > DIGEST_RECENT {
+		ds.recent = ds.recent[1:]
+	}
+
+	ds.Unlock()
+
+	if ds.immediate && ev.LogLevel == "critical" {
+		return ds.mail.send(fmt.Sprintf("sublogmon on %s: %s", ds.hostname, ev.Title), formatEventMail(ev))
+	}
+
+	return nil
+}
+
+// formatEventMail is the body of the mail sent at once for a critical event.
+func formatEventMail(ev *logEvent) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s\n\n", ev.LogLine)
+	fmt.Fprintf(&buf, "Event:    %s\n", ev.EventID)
+	fmt.Fprintf(&buf, "Severity: %s\n", ev.LogLevel)
+	fmt.Fprintf(&buf, "Source:   %s\n", ev.Source)
+	fmt.Fprintf(&buf, "Time:     %s\n", time.Unix(0, ev.Timestamp).Format(time.RFC3339))
+
+	if len(ev.OrigLogLine) > 0 {
+		fmt.Fprintf(&buf, "Log line: %s\n", ev.OrigLogLine)
+	}
+
+	if len(ev.Metadata) > 0 {
+		var keys []string
+
+		for key := range ev.Metadata {
+			keys = append(keys, key)
+		}
+
+		sort.Strings(keys)
+		buf.WriteString("\n")
+
+		for _, key := range keys {
+			fmt.Fprintf(&buf, "  %s = %s\n", key, ev.Metadata[key])
+		}
+
+	}
+
+	return buf.String()
+}
+
+// topCounts lists the most frequent values of a count map, most frequent
+// first.
+func topCounts(counts map[string]int, n int) []string {
+	var vals []string
+
+	for val := range counts {
+		vals = append(vals, val)
+	}
+
+	sort.Slice(vals, func(i, j int) bool {
+
+		if counts[vals[i]] != counts[vals[j]] {
+			return counts[vals[i]] > counts[vals[j]]
+		}
+
+		return vals[i] < vals[j]
+	})
+
+	if len(vals) > n {
+		vals = vals[:n]
+	}
+
+	return vals
+}
+
+// Flush sends the digest of the events since the last one, if there were
+// any, and starts a new one.
+func (ds *digestSink) Flush() error {
+	ds.Lock()
+	now := time.Now()
+
+	if ds.total == 0 {
+		ds.start = now
+		ds.Unlock()
+		return nil
+	}
+
+	var entries []*digestEntry
+	critical := 0
+
+	for _, entry := range ds.entries {
+		entries = append(entries, entry)
+
+		if entry.severity == "critical" {
+			critical += entry.count
+		}
+
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+
+		if entries[i].count != entries[j].count {
+			return entries[i].count > entries[j].count
+		}
+
+		return entries[i].id < entries[j].id
+	})
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d events on %s from %s to %s.\n\n", ds.total, ds.hostname, ds.start.Format("2006-01-02 15:04"), now.Format("2006-01-02 15:04"))
+	fmt.Fprintf(&buf, "%7s  %-9s %s\n", "Count", "Severity", "Event")
+
+	for _, entry := range entries {
+		fmt.Fprintf(&buf, "%7d  %-9s %s\n", entry.count, entry.severity, entry.id)
+	}
+
+	for _, top := range []struct {
+		title  string
+		counts map[string]int
+	}{{"Top applications", ds.apps}, {"Top hosts", ds.hosts}} {
+
+		if len(top.counts) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(&buf, "\n%s:\n", top.title)
+
+		for _, val := range topCounts(top.counts, DIGEST_TOP) {
+			fmt.Fprintf(&buf, "%7d  %s\n", top.counts[val], val)
+		}
+
+	}
+
+	fmt.Fprintf(&buf, "\nLatest events:\n")
+
+	for _, ev := range ds.recent {
+		fmt.Fprintf(&buf, "  %s  %s  %s\n", time.Unix(0, ev.Timestamp).Format("2006-01-02 15:04:05"), ev.EventID, ev.Output)
+	}
+
+	subject := fmt.Sprintf("sublogmon digest for %s: %d events", ds.hostname, ds.total)
+
+	if critical > 0 {
+		subject += fmt.Sprintf(", %d critical", critical)
+	}
+
+	start, counted, apps, hosts, recent, total := ds.start, ds.entries, ds.apps, ds.hosts, ds.recent, ds.total
+	ds.reset(now)
+	ds.Unlock()
+	err := ds.mail.send(subject, buf.String())
+
+	if err != nil {
+		ds.Lock()
+		ds.requeue(start, counted, apps, hosts, recent, total)
+		ds.Unlock()
+	}
+
+	return err
+}
+
+// requeue merges the counts of a digest that could not be sent into the
+// one being collected, so that they go out with the next digest.
+func (ds *digestSink) requeue(start time.Time, entries map[string]*digestEntry, apps, hosts map[string]int, recent []*logEvent, total int) {
+	ds.start = start
+	ds.total += total
+
+	for key, entry := range entries {
+
+		if cur, ok := ds.entries[key]; ok {
+			entry.count += cur.count
+		}
+
+		ds.entries[key] = entry
+	}
+
+	for val, count := range apps {
+		ds.apps[val] += count
+	}
+
+	for val, count := range hosts {
+		ds.hosts[val] += count
+	}
+
+	ds.recent = append(recent, ds.recent...)
+
+	if len(ds.recent) > DIGEST_RECENT {
+		ds.recent = ds.recent[len(ds.recent)-DIGEST_RECENT:]
+	}
+
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpStandIn accepts mail on a local port and passes on every message it
+// is given, headers and body as received. The first reject messages are
+// turned away with a temporary failure.
+func smtpStandIn(t *testing.T, reject int) (string, chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { ln.Close() })
+	messages := make(chan string, 4)
+
+	go func() {
+
+		for {
+			conn, err := ln.Accept()
+
+			if err != nil {
+				return
+			}
+
+			reject = serveSMTP(conn, messages, reject)
+		}
+
+	}()
+
+	return ln.Addr().String(), messages
+}
+
+// serveSMTP speaks SMTP on one connection and returns how many messages
+// are still to be rejected.
+func serveSMTP(conn net.Conn, messages chan string, reject int) int {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "220 localhost ESMTP\r\n")
+
+	for {
+		line, err := r.ReadString('\n')
+
+		if err != nil {
+			return reject
+		}
+
+		switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			fmt.Fprintf(conn, "250 localhost\r\n")
+		case strings.HasPrefix(cmd, "MAIL") && reject > 0:
+			reject--
+			fmt.Fprintf(conn, "451 try again later\r\n")
+		case cmd == "DATA":
+			fmt.Fprintf(conn, "354 go ahead\r\n")
+			var msg strings.Builder
+
+			for {
+				line, err := r.ReadString('\n')
+
+				if err != nil {
+					return reject
+				}
+
+				if line == ".\r\n" {
+					break
+				}
+
+				msg.WriteString(strings.TrimPrefix(line, "."))
+			}
+
+			messages <- strings.Replace(msg.String(), "\r\n", "\n", -1)
+			fmt.Fprintf(conn, "250 queued\r\n")
+		case cmd == "QUIT":
+			fmt.Fprintf(conn, "221 bye\r\n")
+			return reject
+		default:
+			fmt.Fprintf(conn, "250 ok\r\n")
+		}
+
+	}
+
+}
+
+// receive waits for the next message the stand-in was given.
+func receive(t *testing.T, messages chan string) string {
+
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no mail was sent")
+	}
+
+	return ""
+}
+
+func testEvent(id, severity, output string, meta map[string]string) *logEvent {
+	now := time.Now().UnixNano()
+	return &logEvent{slmData: slmData{id, severity, now, output, "", meta, now}, Source: "kernel", Output: output, Title: output}
+}
+
+func TestDigestOverSMTP(t *testing.T) {
+	relay, messages := smtpStandIn(t, 0)
+	mail := &mailer{from: "sublogmon@test", to: []string{"admin@test"}, relay: relay}
+	ds := newDigestSink(mail, time.Hour, true)
+
+	events := []*logEvent{
+		testEvent("grsec-denied", "alert", "grsec denied operation exec to application /usr/bin/foo", map[string]string{"process": "/usr/bin/foo"}),
+		testEvent("grsec-denied", "alert", "grsec denied operation exec to application /usr/bin/foo", map[string]string{"process": "/usr/bin/foo"}),
+		testEvent("seccomp", "critical", "SECCOMP violation detected when application firefox attempted to call syscall ptrace", map[string]string{"exename": "firefox"}),
+	}
+
+	for _, ev := range events {
+
+		if err := ds.Send(ev); err != nil {
+			t.Fatal(err)
+		}
+
+	}
+
+	// The critical event is mailed at once, on its own.
+	msg := receive(t, messages)
+
+	if !strings.Contains(msg, "Subject: sublogmon on ") || !strings.Contains(msg, "Event:    seccomp") || !strings.Contains(msg, "exename = firefox") {
+		t.Errorf("got immediate mail:\n%s", msg)
+	}
+
+	if err := ds.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	msg = receive(t, messages)
+
+	for _, want := range []string{
+		"From: sublogmon@test\n",
+		"To: admin@test\n",
+		": 3 events, 1 critical\n",
+		"      2  alert     grsec-denied\n",
+		"      1  critical  seccomp\n",
+		"Top applications:\n      2  /usr/bin/foo\n      1  firefox\n",
+		"Latest events:\n",
+	} {
+
+		if !strings.Contains(msg, want) {
+			t.Errorf("the digest lacks %q:\n%s", want, msg)
+		}
+
+	}
+
+	// Nothing is sent for a period without events.
+	if err := ds.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-messages:
+		t.Errorf("an empty digest was sent:\n%s", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+}
+
+// A digest that could not be sent is not lost; its events go out with the
+// next one.
+func TestDigestRetriedAfterFailure(t *testing.T) {
+	relay, messages := smtpStandIn(t, 1)
+	mail := &mailer{from: "sublogmon@test", to: []string{"admin@test"}, relay: relay}
+	ds := newDigestSink(mail, time.Hour, false)
+
+	for _, ev := range []*logEvent{
+		testEvent("grsec-denied", "alert", "grsec denied operation exec", map[string]string{"process": "/usr/bin/foo"}),
+		testEvent("seccomp", "critical", "SECCOMP violation", map[string]string{"exename": "firefox"}),
+	} {
+
+		if err := ds.Send(ev); err != nil {
+			t.Fatal(err)
+		}
+
+	}
+
+	if err := ds.Flush(); err == nil {
+		t.Fatal("the rejected digest was reported as sent")
+	}
+
+	if err := ds.Send(testEvent("grsec-denied", "alert", "grsec denied operation exec", map[string]string{"process": "/usr/bin/foo"})); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ds.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := receive(t, messages)
+
+	for _, want := range []string{
+		": 3 events, 1 critical\n",
+		"      2  alert     grsec-denied\n",
+		"      1  critical  seccomp\n",
+		"Top applications:\n      2  /usr/bin/foo\n      1  firefox\n",
+	} {
+
+		if !strings.Contains(msg, want) {
+			t.Errorf("the digest lacks %q:\n%s", want, msg)
+		}
+
+	}
+
+	if strings.Count(msg, "grsec denied operation exec") != 2 {
+		t.Errorf("the digest does not list both grsec events:\n%s", msg)
+	}
+
+}
+
+func TestDigestThroughSendmail(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "mail")
+	sendmail := filepath.Join(dir, "sendmail")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" > %s.args\ncat > %s\n", out, out)
+
+	if err := ioutil.WriteFile(sendmail, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	mail := &mailer{from: "sublogmon@test", to: []string{"admin@test", "sec@test"}, sendmail: sendmail}
+	ds := newDigestSink(mail, time.Hour, false)
+
+	if err := ds.Send(testEvent("pax-termination", "critical", "PAX terminated process: foo", map[string]string{"application": "foo"})); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(out); err == nil {
+		t.Fatal("a critical event was mailed at once without -digest-immediate")
+	}
+
+	if err := ds.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	args, err := ioutil.ReadFile(out + ".args")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(args) != "-t -i -f sublogmon@test\n" {
+		t.Errorf("sendmail got arguments %q", args)
+	}
+
+	msg, _ := ioutil.ReadFile(out)
+
+	for _, want := range []string{"To: admin@test, sec@test\n", ": 1 events, 1 critical\n", "pax-termination"} {
+
+		if !strings.Contains(string(msg), want) {
+			t.Errorf("the digest lacks %q:\n%s", want, msg)
+		}
+
+	}
+
+}
+
+func TestSendmailFailure(t *testing.T) {
+	sendmail := filepath.Join(t.TempDir(), "sendmail")
+
+	if err := ioutil.WriteFile(sendmail, []byte("#!/bin/sh\necho 'no recipients' >&2\nexit 75\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	mail := &mailer{from: "sublogmon@test", to: []string{"admin@test"}, sendmail: sendmail}
+
+	if err := mail.send("test", "body"); err == nil || !strings.Contains(err.Error(), "no recipients") {
+		t.Errorf("got error %v, want sendmail's message", err)
+	}
+
+}
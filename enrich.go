@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PROC_CACHE_TTL is how long process details are reused before /proc is read
+// again; pids are recycled, so this is kept short.
+const PROC_CACHE_TTL = 5 * time.Second
+
+const MAX_PARENT_CHAIN = 16
+
+const DPKG_INFO_DIR = "/var/lib/dpkg/info"
+
+// An EnrichFunc adds derived metadata keys to an event, based on the fields
+// captured from its log line.
+type EnrichFunc func(rmap map[string]string)
+
+// An Enricher lists every key its Func may add.
+type Enricher struct {
+	Name string
+	Func EnrichFunc
+	Adds []string
+}
+
+var (
+	Enrichers = []Enricher{
+		{Name: "user", Func: enrichUsers, Adds: suffixed(uidFields, "_user")},
+		{Name: "process", Func: enrichProcess, Adds: []string{"cmdline", "parents"}},
+		{Name: "package", Func: enrichPackage, Adds: []string{"package"}},
+		{Name: "sandbox", Func: enrichSandbox, Adds: []string{"sandbox"}},
+		{Name: "network", Func: enrichNetwork, Adds: append(suffixed(ipFields, "_class", "_tor_exit", "_blocklisted"), suffixed(portFields, "_service")...)}}
+)
+
+// The captured fields each enricher looks at.
+var uidFields = []string{"uid", "auid", "euid", "suid", "fsuid", "ouid", "ruid"}
+var exeFields = []string{"exe", "exename"}
+
+// suffixed returns every field name with every suffix appended.
+func suffixed(fields []string, suffixes ...string) []string {
+	var keys []string
+
+	for _, field := range fields {
+
+		for _, suffix := range suffixes {
+			keys = append(keys, field+suffix)
+		}
+
+	}
+
+	return keys
+}
+
+func findEnricher(name string) EnrichFunc {
+
+	if en := findEnricherEntry(name); en != nil {
+		return en.Func
+	}
+
+	return nil
+}
+
+func findEnricherEntry(name string) *Enricher {
+
+	for i := 0; i < len(Enrichers); i++ {
+
+		if Enrichers[i].Name == name {
+			return &Enrichers[i]
+		}
+
+	}
+
+	return nil
+}
+
+// enrichEvent runs the enrichers configured for a filter. The keys an
+// enricher adds belong to it: a capture of the same name is replaced, or
+// removed if the enricher has nothing to say, so that what a log line says
+// cannot pass for what sublogmon found out.
+func enrichEvent(fil *LogFilter, rmap map[string]string) {
+
+	for _, fn := range fil.enrichers {
+		fn(rmap)
+	}
+
+}
+
+// setEnriched sets a key an enricher owns, or removes it if val is empty.
+func setEnriched(rmap map[string]string, key, val string) {
+
+	if len(val) == 0 {
+		delete(rmap, key)
+		return
+	}
+
+	rmap[key] = val
+}
+
+var passwdCache struct {
+	mtime time.Time
+	names map[string]string
+}
+
+// lookupUser maps a numeric uid to a user name using /etc/passwd, which is
+// only read again when it changes.
+func lookupUser(uid string) string {
+
+	// The audit subsystem's way of saying "not set".
+	if uid == "4294967295" || uid == "-1" {
+		return "unset"
+	}
+
+	fi, err := os.Stat("/etc/passwd")
+
+	if err != nil {
+		return ""
+	}
+
+	if passwdCache.names == nil || !fi.ModTime().Equal(passwdCache.mtime) {
+		f, err := os.Open("/etc/passwd")
+
+		if err != nil {
+			return ""
+		}
+
+		names := make(map[string]string)
+		scanner := bufio.NewScanner(f)
+
+		for scanner.Scan() {
+			fields := strings.Split(scanner.Text(), ":")
+
+			if len(fields) > 2 {
+				names[fields[2]] = fields[0]
+			}
+
+		}
+
+		f.Close()
+		passwdCache.names = names
+		passwdCache.mtime = fi.ModTime()
+	}
+
+	return passwdCache.names[uid]
+}
+
+// enrichUsers adds <field>_user with the user name for every uid-like field.
+func enrichUsers(rmap map[string]string) {
+
+	for _, key := range uidFields {
+		name := ""
+
+		if uid, ok := rmap[key]; ok {
+			name = lookupUser(uid)
+		}
+
+		setEnriched(rmap, key+"_user", name)
+	}
+
+}
+
+type procInfo struct {
+	cmdline string
+	parents string
+	fetched time.Time
+}
+
+var procCache = make(map[int]procInfo)
+
+// procStat returns the command name and parent pid of a process.
+func procStat(pid int) (string, int, bool) {
+	data, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+
+	if err != nil {
+		return "", 0, false
+	}
+
+	// The command name is in parentheses and may itself contain spaces or
+	// parentheses, so look for the last closing one.
+	stat := string(data)
+	open := strings.Index(stat, "(")
+	end := strings.LastIndex(stat, ")")
+
+	if open < 0 || end < open {
+		return "", 0, false
+	}
+
+	fields := strings.Fields(stat[end+1:])
+
+	if len(fields) < 2 {
+		return "", 0, false
+	}
+
+	ppid, err := strconv.Atoi(fields[1])
+
+	if err != nil {
+		return "", 0, false
+	}
+
+	return stat[open+1 : end], ppid, true
+}
+
+func lookupProcess(pid int) (procInfo, bool) {
+	now := time.Now()
+
+	if info, ok := procCache[pid]; ok && now.Sub(info.fetched) < PROC_CACHE_TTL {
+		return info, true
+	}
+
+	for cpid, info := range procCache {
+
+		if now.Sub(info.fetched) >= PROC_CACHE_TTL {
+			delete(procCache, cpid)
+		}
+
+	}
+
+	data, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/cmdline")
+
+	if err != nil {
+		return procInfo{}, false
+	}
+
+	info := procInfo{cmdline: strings.TrimSpace(strings.Replace(string(data), "\x00", " ", -1)), fetched: now}
+
+	var chain []string
+	cur := pid
+
+	for i := 0; i < MAX_PARENT_CHAIN && cur > 0; i++ {
+		comm, ppid, ok := procStat(cur)
+
+		if !ok {
+			break
+		}
+
+		chain = append(chain, comm+"("+strconv.Itoa(cur)+")")
+		cur = ppid
+	}
+
+	info.parents = strings.Join(chain, " < ")
+	procCache[pid] = info
+	return info, true
+}
+
+// enrichProcess adds the command line and the chain of parent processes for
+// the pid field, provided the process is still around.
+func enrichProcess(rmap map[string]string) {
+	var info procInfo
+
+	if pid, err := strconv.Atoi(rmap["pid"]); err == nil && pid > 0 {
+		info, _ = lookupProcess(pid)
+	}
+
+	setEnriched(rmap, "cmdline", info.cmdline)
+	setEnriched(rmap, "parents", info.parents)
+}
+
+var dpkgCache struct {
+	mtime  time.Time
+	owners map[string]string
+}
+
+// lookupPackage returns the Debian package that installed a file. The index
+// of the dpkg database is only rebuilt when packages have been installed or
+// removed since it was last read.
+func lookupPackage(pathname string) string {
+	fi, err := os.Stat(DPKG_INFO_DIR)
+
+	if err != nil {
+		return ""
+	}
+
+	if dpkgCache.owners == nil || !fi.ModTime().Equal(dpkgCache.mtime) {
+		lists, _ := filepath.Glob(filepath.Join(DPKG_INFO_DIR, "*.list"))
+		owners := make(map[string]string)
+
+		for _, list := range lists {
+			pkg := strings.TrimSuffix(filepath.Base(list), ".list")
+			data, err := ioutil.ReadFile(list)
+
+			if err != nil {
+				continue
+			}
+
+			for _, line := range strings.Split(string(data), "\n") {
+
+				if len(line) > 0 {
+					owners[line] = pkg
+				}
+
+			}
+
+		}
+
+		dpkgCache.owners = owners
+		dpkgCache.mtime = fi.ModTime()
+	}
+
+	if pkg, ok := dpkgCache.owners[pathname]; ok {
+		return pkg
+	}
+
+	if real, err := filepath.EvalSymlinks(pathname); err == nil {
+		return dpkgCache.owners[real]
+	}
+
+	return ""
+}
+
+// enrichPackage adds the package owning the executable named in the event.
+func enrichPackage(rmap map[string]string) {
+	pkg := ""
+
+	for _, key := range exeFields {
+
+		if exe, ok := rmap[key]; ok && filepath.IsAbs(exe) {
+			pkg = lookupPackage(exe)
+			break
+		}
+
+	}
+
+	setEnriched(rmap, "package", pkg)
+}
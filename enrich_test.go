@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+// Keys an enricher adds cannot be supplied by the log line itself.
+func TestEnrichmentReplacesCaptures(t *testing.T) {
+	rmap := map[string]string{
+		"uid":          "0",
+		"uid_user":     "nobody",
+		"auid_user":    "nobody",
+		"pid":          "0",
+		"cmdline":      "/usr/bin/innocent",
+		"parents":      "systemd(1)",
+		"exe":          "/nonexistent/bin/tool",
+		"package":      "coreutils",
+		"sandbox":      "spotify",
+		"ip":           "example.org",
+		"ip_class":     "private",
+		"port_service": "ssh",
+	}
+
+	enrichUsers(rmap)
+	enrichProcess(rmap)
+	enrichPackage(rmap)
+	enrichSandbox(rmap)
+	enrichNetwork(rmap)
+
+	if rmap["uid_user"] != lookupUser("0") {
+		t.Errorf("got uid_user %q, want %q", rmap["uid_user"], lookupUser("0"))
+	}
+
+	for _, key := range []string{"auid_user", "cmdline", "parents", "package", "sandbox", "ip_class", "port_service"} {
+
+		if val, ok := rmap[key]; ok {
+			t.Errorf("captured %s = %q was kept", key, val)
+		}
+
+	}
+
+}
+
+// Every address or network on a line is listed, wherever it is on the line.
+func TestAddrListLoad(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "tor-exits.txt")
+	content := `# Tor exit-addresses
+ExitNode 0011BD2485AD45D984EC4159C88FC066E5E3300E
+ExitAddress 198.51.100.7 2024-03-08 22:09:55
+10.1.0.0/16 192.0.2.1 # two on one line
+`
+
+	if err := ioutil.WriteFile(fname, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var al addrList
+
+	if !al.load(fname) {
+		t.Fatal("the list was not read")
+	}
+
+	for addr, want := range map[string]bool{"198.51.100.7": true, "10.1.2.3": true, "192.0.2.1": true, "192.0.2.2": false} {
+
+		if got := al.contains(net.ParseIP(addr)); got != want {
+			t.Errorf("%s: got %v, want %v", addr, got, want)
+		}
+
+	}
+
+}
+
+// A suppression can drop the events of one sandbox, by the name the sandbox
+// enrichment finds rather than one the line claims.
+func TestSandboxSuppression(t *testing.T) {
+	dir := t.TempDir()
+	prof := `{ "name": "spotify", "path": "/usr/share/spotify/spotify" }`
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "spotify.json"), []byte(prof), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ozProfileDir = dir
+	ozCache.profiles = nil
+
+	defer func() {
+		ozProfileDir = OZ_PROFILE_DIR
+		ozCache.profiles = nil
+	}()
+
+	logs := loadTestSuppressions(t, `[
+{ "Description": "test", "SourceName": "test", "PathName": "/tmp/audit.log",
+  "Filters": [
+    { "ID": "seccomp", "Regexp": "exe=\"(?P<exe>[^\"]+)\"(?: sandbox=(?P<sandbox>\\S+))?", "OutputStr": "seccomp violation by {exe}", "Enrich": ["sandbox"] }
+  ]
+}]`, `[ { "description": "spotify noise", "metadata": { "sandbox": "^spotify$" } } ]`)
+
+	events := runLines(&logs[0],
+		`type=SECCOMP exe="/usr/share/spotify/spotify" sig=0`,
+		`type=SECCOMP exe="/usr/bin/evince" sandbox=spotify sig=0`)
+
+	if len(events) != 1 || events[0].Output != "seccomp violation by /usr/bin/evince" {
+		t.Errorf("got events %v, want only the one outside the sandbox", eventIDs(events))
+	}
+
+}
+
+// A suppression can drop events by the class the network enrichment gives
+// an address, which the line cannot claim for itself.
+func TestNetworkSuppression(t *testing.T) {
+	logs := loadTestSuppressions(t, `[
+{ "Description": "test", "SourceName": "test", "PathName": "/tmp/syslog",
+  "Filters": [
+    { "ID": "fw-deny", "Regexp": "DENY (?P<ip>[0-9.]+)(?: class=(?P<ip_class>\\w+))?", "OutputStr": "denied {ip}", "Enrich": ["network"] }
+  ]
+}]`, `[ { "description": "LAN denials", "metadata": { "ip_class": "^(loopback|private)$" } } ]`)
+
+	events := runLines(&logs[0],
+		"fw-daemon: DENY 192.168.1.20",
+		"fw-daemon: DENY 203.0.113.9 class=private",
+		"fw-daemon: DENY 127.0.0.1")
+
+	if len(events) != 1 || events[0].Output != "denied 203.0.113.9" || events[0].Metadata["ip_class"] != "public" {
+		t.Errorf("got events %v, want only the public address", eventIDs(events))
+	}
+
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const EXEC_DEFAULT_TIMEOUT = 10 * time.Second
+const EXEC_DEFAULT_LIMIT = 5
+const EXEC_DEFAULT_PER = time.Minute
+
+// EXEC_OUTPUT_MAX is how much of a command's stdout and stderr is kept for
+// its follow-up event.
+const EXEC_OUTPUT_MAX = 4096
+
+// ExecAction is a command run when a filter raises an event. Every element
+// of Argv is an output template; the command is run directly, never through
+// a shell, so field values cannot inject commands or split into several
+// arguments. The command itself is a literal absolute path, and an argument
+// that only starts with "-" because of a field value is refused, so that a
+// value cannot pass itself off as an option, unless AllowOptions is set. At
+// most Limit commands are started per Per, and a command still running after
+// Timeout is killed.
+type ExecAction struct {
+	Argv         []string
+	Timeout      string `json:",omitempty"`
+	Limit        int    `json:",omitempty"`
+	Per          string `json:",omitempty"`
+	AllowOptions bool   `json:",omitempty"`
+	timeout      time.Duration
+	per          time.Duration
+	window       time.Time
+	runs         int
+	skipped      int
+}
+
+// execResult is what became of a command, passed back to the main loop to
+// be reported as a follow-up event.
+type execResult struct {
+	eventID  string
+	source   string
+	argv     []string
+	skipped  int
+	exitCode int
+	stdout   string
+	stderr   string
+	took     time.Duration
+	err      error
+}
+
+var placeholder = regexp.MustCompile(`\{(\w+)\}`)
+
+// execSlots limits how many commands run at the same time, set with
+// -exec-max. execResults carries their results back to the main loop.
+var execSlots chan struct{}
+var execResults = make(chan *execResult, SINK_QUEUE_SIZE)
+
+// setupExec checks a filter's Exec action and reads its durations.
+func setupExec(fil *LogFilter) error {
+	ea := fil.Exec
+
+	if ea == nil {
+		return nil
+	}
+
+	if len(ea.Argv) == 0 || len(ea.Argv[0]) == 0 {
+		return fmt.Errorf("Exec has no command")
+	}
+
+	if strings.ContainsAny(ea.Argv[0], "{}") || !filepath.IsAbs(ea.Argv[0]) {
+		return fmt.Errorf("Exec command \"%s\" is not a literal absolute path", ea.Argv[0])
+	}
+
+	ea.timeout = EXEC_DEFAULT_TIMEOUT
+	ea.per = EXEC_DEFAULT_PER
+	var err error
+
+	if len(ea.Timeout) > 0 {
+
+		if ea.timeout, err = time.ParseDuration(ea.Timeout); err != nil || ea.timeout <= 0 {
+			return fmt.Errorf("Exec has a bad Timeout \"%s\"", ea.Timeout)
+		}
+
+	}
+
+	if len(ea.Per) > 0 {
+
+		if ea.per, err = time.ParseDuration(ea.Per); err != nil || ea.per <= 0 {
+			return fmt.Errorf("Exec has a bad Per \"%s\"", ea.Per)
+		}
+
+	}
+
+	if ea.Limit <= 0 {
+		ea.Limit = EXEC_DEFAULT_LIMIT
+	}
+
+	return nil
+}
+
+// renderArgv fills in an Exec action's argument templates. Unlike output
+// strings, a placeholder for a field the event does not have is an error
+// rather than being left in: the command is not run at all. So is an argument
+// that starts with "-" where its template does not.
+func renderArgv(ea *ExecAction, rmap map[string]string, typed map[string]interface{}) ([]string, error) {
+	var argv []string
+
+	for _, tmpl := range ea.Argv {
+
+		for _, m := range placeholder.FindAllStringSubmatch(tmpl, -1) {
+
+			if _, ok := rmap[m[1]]; !ok {
+				return nil, fmt.Errorf("the event has no field %s", m[1])
+			}
+
+		}
+
+		arg := tmpl
+
+		if strings.Contains(tmpl, "{") {
+			arg = formatTyped(tmpl, rmap, typed)
+
+			if len(arg) == 0 {
+				return nil, fmt.Errorf("cannot format \"%s\"", tmpl)
+			}
+
+			if !ea.AllowOptions && strings.HasPrefix(arg, "-") && !strings.HasPrefix(tmpl, "-") {
+				return nil, fmt.Errorf("\"%s\" would be taken as an option: %s", tmpl, arg)
+			}
+
+		}
+
+		argv = append(argv, arg)
+	}
+
+	return argv, nil
+}
+
+// allow applies an Exec action's rate limit. Runs that are skipped are
+// counted, so that the next follow-up event can say how many there were.
+func (ea *ExecAction) allow(now time.Time) bool {
+
+	if now.Sub(ea.window) >= ea.per {
+		ea.window = now
+		ea.runs = 0
+	}
+
+	if ea.runs >= ea.Limit {
+		return false
+	}
+
+	ea.runs++
+	return true
+}
+
+// skip records that an Exec action did not run. Only the first of a series
+// of skips is mentioned on the console.
+func (ea *ExecAction) skip(fil *LogFilter, why string) {
+	ea.skipped++
+
+	if ea.skipped == 1 && dash == nil {
+		flushRepeats()
+		fmt.Printf("Warning: not running the Exec action of filter %s: %s\n", fil.ID, why)
+	}
+
+}
+
+// runExec starts a filter's Exec action for an event, if its rate limit and
+// the limit on commands running at once allow.
+func runExec(src *LogAuditFile, fil *LogFilter, rmap map[string]string, typed map[string]interface{}) {
+	ea := fil.Exec
+	argv, err := renderArgv(ea, rmap, typed)
+
+	if err != nil {
+		ea.skip(fil, err.Error())
+		return
+	}
+
+	if !ea.allow(time.Now()) {
+		ea.skip(fil, fmt.Sprintf("more than %d runs per %v", ea.Limit, ea.per))
+		return
+	}
+
+	select {
+	case execSlots <- struct{}{}:
+	default:
+		ea.runs--
+		ea.skip(fil, fmt.Sprintf("%d commands are already running", cap(execSlots)))
+		return
+	}
+
+	res := &execResult{eventID: fil.ID, source: sourceLabel(src), argv: argv, skipped: ea.skipped}
+	ea.skipped = 0
+	timeout := ea.timeout
+
+	go func() {
+		defer func() { <-execSlots }()
+
+		var stdout, stderr bytes.Buffer
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+
+		start := time.Now()
+		res.err = cmd.Run()
+		res.took = time.Since(start)
+		res.exitCode = -1
+
+		if cmd.ProcessState != nil {
+			res.exitCode = cmd.ProcessState.ExitCode()
+		}
+
+		if ctx.Err() == context.DeadlineExceeded {
+			res.err = fmt.Errorf("killed after %v", timeout)
+		} else if _, ok := res.err.(*exec.ExitError); ok {
+			res.err = nil
+		}
+
+		res.stdout = truncateOutput(stdout.String())
+		res.stderr = truncateOutput(stderr.String())
+		execResults <- res
+	}()
+
+}
+
+func truncateOutput(s string) string {
+
+	if len(s) > EXEC_OUTPUT_MAX {
+		return s[:EXEC_OUTPUT_MAX] + "..."
+	}
+
+	return strings.TrimRight(s, "\n")
+}
+
+// reportExec raises the follow-up event for a command that has finished,
+// with the ID of the event that ran it plus "-exec". It is a warning if the
+// command could not be run or did not exit with 0.
+func reportExec(res *execResult) {
+	metadata := map[string]string{
+		"event":     res.eventID,
+		"source":    res.source,
+		"argv":      strings.Join(quoteArgs(res.argv), " "),
+		"exit_code": strconv.Itoa(res.exitCode),
+		"stdout":    res.stdout,
+		"stderr":    res.stderr,
+		"duration":  res.took.Round(time.Millisecond).String(),
+	}
+
+	if res.skipped > 0 {
+		metadata["skipped"] = strconv.Itoa(res.skipped)
+	}
+
+	severity := "info"
+	msg := fmt.Sprintf("%s for %s exited with %d", res.argv[0], res.eventID, res.exitCode)
+
+	if res.err != nil {
+		severity = "warning"
+		metadata["error"] = res.err.Error()
+		msg = fmt.Sprintf("%s for %s failed: %v", res.argv[0], res.eventID, res.err)
+	} else if res.exitCode != 0 {
+		severity = "warning"
+	}
+
+	now := time.Now().UnixNano()
+	data := slmData{res.eventID + "-exec", severity, now, msg, "", metadata, now}
+	ev := &logEvent{slmData: data, Source: res.source, Output: msg, Title: msg, Console: msg, Syslog: msg}
+
+	if dash == nil {
+		flushRepeats()
+		fmt.Println("* ", colorize(severityColors[severity], msg))
+	}
+
+	deliverEvent(ev)
+}
+
+// quoteArgs quotes the arguments that would otherwise be ambiguous when the
+// command line is shown.
+func quoteArgs(argv []string) []string {
+	var out []string
+
+	for _, arg := range argv {
+
+		if len(arg) == 0 || strings.ContainsAny(arg, " \t\n\"'\\") {
+			arg = strconv.Quote(arg)
+		}
+
+		out = append(out, arg)
+	}
+
+	return out
+}
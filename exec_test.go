@@ -0,0 +1,63 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSetupExecCommand(t *testing.T) {
+	tests := []struct {
+		argv []string
+		ok   bool
+	}{
+		{[]string{"/usr/local/sbin/snapshot-sandbox", "{sandbox}"}, true},
+		{[]string{"snapshot-sandbox", "{sandbox}"}, false},
+		{[]string{"/usr/lib/{sandbox}/hook"}, false},
+		{[]string{"{exename}", "--version"}, false},
+		{[]string{""}, false},
+	}
+
+	for _, test := range tests {
+		fil := &LogFilter{ID: "test", Exec: &ExecAction{Argv: test.argv}}
+
+		if err := setupExec(fil); (err == nil) != test.ok {
+			t.Errorf("%q: got error %v", test.argv, err)
+		}
+
+	}
+
+}
+
+func TestRenderArgvOptions(t *testing.T) {
+	rmap := map[string]string{"pid": "1234", "exename": "--exec=/bin/sh", "app": "firefox"}
+	tests := []struct {
+		argv  []string
+		allow bool
+		want  []string
+	}{
+		{[]string{"/bin/kill", "-STOP", "{pid}"}, false, []string{"/bin/kill", "-STOP", "1234"}},
+		{[]string{"/bin/snap", "--name={app}"}, false, []string{"/bin/snap", "--name=firefox"}},
+		{[]string{"/bin/snap", "{exename}"}, false, nil},
+		{[]string{"/bin/snap", "--", "{exename}"}, true, []string{"/bin/snap", "--", "--exec=/bin/sh"}},
+	}
+
+	for _, test := range tests {
+		ea := &ExecAction{Argv: test.argv, AllowOptions: test.allow}
+		argv, err := renderArgv(ea, rmap, nil)
+
+		if test.want == nil {
+
+			if err == nil {
+				t.Errorf("%q: a value starting with - was passed as %q", test.argv, argv)
+			}
+
+			continue
+		}
+
+		if err != nil || !reflect.DeepEqual(argv, test.want) {
+			t.Errorf("%q: got %q, %v, want %q", test.argv, argv, err, test.want)
+		}
+
+	}
+
+}
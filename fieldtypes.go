@@ -0,0 +1,489 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The types a field can be declared with, as "name:type" in Fields.
+var FieldTypes = []string{"int", "hex", "ip", "duration", "timestamp"}
+
+var conditionSyntax = regexp.MustCompile(`^\s*(\w+)\s*(==|!=|<=|>=|<|>|not in|in)\s*(.+?)\s*$`)
+
+// condition is a compiled entry of a filter's Conditions, such as
+// "port not in [80,443]", "uid < 1000" or "ip not in 10.0.0.0/8".
+type condition struct {
+	text   string
+	field  string
+	kind   string
+	op     string
+	values []interface{}
+	nets   []*net.IPNet
+}
+
+// splitFieldSpec splits a Fields entry into its name and type.
+func splitFieldSpec(spec string) (string, string, error) {
+	parts := strings.SplitN(spec, ":", 2)
+
+	if len(parts) == 1 {
+		return spec, "", nil
+	}
+
+	for _, kind := range FieldTypes {
+
+		if parts[1] == kind {
+			return parts[0], kind, nil
+		}
+
+	}
+
+	return "", "", fmt.Errorf("field %s has unknown type \"%s\"", parts[0], parts[1])
+}
+
+// parseTimestamp understands the timestamps found in the logs sublogmon
+// reads: Unix seconds as used by auditd, RFC 3339 and the classic syslog
+// format, which lacks a year.
+func parseTimestamp(val string) (time.Time, error) {
+	return parseTimestampIn(val, time.Local)
+}
+
+// parseTimestampIn is parseTimestamp for timestamps that, lacking a zone,
+// are in loc.
+func parseTimestampIn(val string, loc *time.Location) (time.Time, error) {
+
+	if t, err := parseEpoch(val); err == nil {
+		return t, nil
+	}
+
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05", "2006/01/02 15:04:05"} {
+
+		if t, err := time.ParseInLocation(layout, val, loc); err == nil {
+			return t, nil
+		}
+
+	}
+
+	t, err := time.ParseInLocation(time.StampMicro, val, loc)
+
+	if err != nil {
+		t, err = time.ParseInLocation(time.Stamp, val, loc)
+	}
+
+	if err != nil {
+		return time.Time{}, fmt.Errorf("cannot parse timestamp \"%s\"", val)
+	}
+
+	return inferYear(t, time.Now()), nil
+}
+
+// parseEpoch parses Unix seconds with an optional fraction, such as the
+// "1364481363.243" of audit records, without the rounding errors of going
+// through a float.
+func parseEpoch(val string) (time.Time, error) {
+	parts := strings.SplitN(val, ".", 2)
+	secs, err := strconv.ParseInt(parts[0], 10, 64)
+
+	if err != nil || strings.HasPrefix(parts[0], "+") {
+		return time.Time{}, fmt.Errorf("cannot parse timestamp \"%s\"", val)
+	}
+
+	var nsecs int64
+
+	if len(parts) == 2 {
+		frac := parts[1]
+
+		if len(frac) == 0 || len(frac) > 9 || strings.Trim(frac, "0123456789") != "" {
+			return time.Time{}, fmt.Errorf("cannot parse timestamp \"%s\"", val)
+		}
+
+		nsecs, _ = strconv.ParseInt(frac+strings.Repeat("0", 9-len(frac)), 10, 64)
+	}
+
+	return time.Unix(secs, nsecs), nil
+}
+
+// inferYear gives a date parsed without a year the year that puts it
+// closest before now. A day of leeway is allowed for clocks that are off, so
+// a line from early January read just before midnight on New Year's Eve is
+// from the coming year, while a line from late December read in early
+// January is from last year. February 29 only goes to leap years.
+func inferYear(t, now time.Time) time.Time {
+	now = now.In(t.Location())
+
+	for year := now.Year() + 1; year >= now.Year()-8; year-- {
+		c := time.Date(year, t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+
+		if c.Month() == t.Month() && c.Sub(now) <= 24*time.Hour {
+			return c
+		}
+
+	}
+
+	return t
+}
+
+// convertField turns a captured string into a value of the declared type:
+// int64 for int and hex, net.IP, time.Duration or time.Time. Hex values too
+// large for an int64 are rejected rather than wrapped around.
+func convertField(kind, val string) (interface{}, error) {
+
+	switch kind {
+	case "int":
+		return strconv.ParseInt(val, 10, 64)
+	case "hex":
+		n, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(val), "0x"), 16, 63)
+		return int64(n), err
+	case "ip":
+		ip := net.ParseIP(strings.Trim(val, "[]"))
+
+		if ip == nil {
+			return nil, fmt.Errorf("\"%s\" is not an IP address", val)
+		}
+
+		return ip, nil
+	case "duration":
+
+		// Bare numbers are seconds.
+		if secs, err := strconv.ParseFloat(val, 64); err == nil {
+			return time.Duration(secs * float64(time.Second)), nil
+		}
+
+		return time.ParseDuration(val)
+	case "timestamp":
+		return parseTimestamp(val)
+	}
+
+	return val, nil
+}
+
+// setupFieldTypes reads the types declared in a filter's Fields and compiles
+// its Conditions. A condition has to be about a field the filter's events
+// can have: a capture of its regexp, a header field of the source's Format,
+// a key one of its enrichments adds, or logfile or tags. Only the fields a
+// parser finds are not known before it has a line.
+func setupFieldTypes(fil *LogFilter, src *LogAuditFile) error {
+	fil.fieldTypes = make(map[string]string)
+
+	for _, spec := range fil.Fields {
+		name, kind, err := splitFieldSpec(spec)
+
+		if err != nil {
+			return err
+		}
+
+		if len(kind) > 0 {
+			fil.fieldTypes[name] = kind
+		}
+
+	}
+
+	known := map[string]bool{"logfile": true, "tags": true}
+
+	if fil.Regcomp != nil {
+
+		for _, name := range fil.Regcomp.SubexpNames() {
+			known[name] = true
+		}
+
+	}
+
+	for _, name := range fil.Enrich {
+
+		if en := findEnricherEntry(name); en != nil {
+
+			for _, key := range en.Adds {
+				known[key] = true
+			}
+
+		}
+
+	}
+
+	fil.conditions = nil
+
+	for _, text := range fil.Conditions {
+		cond, err := parseCondition(text, fil.fieldTypes)
+
+		if err != nil {
+			return err
+		}
+
+		if fil.parse == nil && !known[cond.field] && !hasHeaderField(src, cond.field) {
+			return fmt.Errorf("condition \"%s\" uses %s, which no capture, header field or enrichment provides", text, cond.field)
+		}
+
+		fil.conditions = append(fil.conditions, cond)
+	}
+
+	return nil
+}
+
+func parseCondition(text string, kinds map[string]string) (*condition, error) {
+	m := conditionSyntax.FindStringSubmatch(text)
+
+	if m == nil {
+		return nil, fmt.Errorf("cannot parse condition \"%s\"", text)
+	}
+
+	cond := &condition{text: text, field: m[1], kind: kinds[m[1]], op: m[2]}
+	literals := []string{m[3]}
+
+	if strings.HasPrefix(m[3], "[") && strings.HasSuffix(m[3], "]") {
+		literals = strings.Split(m[3][1:len(m[3])-1], ",")
+	}
+
+	ordered := cond.op == "<" || cond.op == "<=" || cond.op == ">" || cond.op == ">="
+
+	if ordered && (len(literals) != 1 || cond.kind == "" || cond.kind == "ip") {
+		return nil, fmt.Errorf("condition \"%s\" compares a field that is not a number, duration or timestamp, or with a list", text)
+	}
+
+	for _, lit := range literals {
+		lit = strings.Trim(strings.TrimSpace(lit), "\"'")
+
+		if cond.kind == "ip" {
+			_, ipnet, err := net.ParseCIDR(lit)
+
+			if err != nil {
+				ip := net.ParseIP(lit)
+
+				if ip == nil {
+					return nil, fmt.Errorf("condition \"%s\": \"%s\" is not an IP address or network", text, lit)
+				}
+
+				bits := 8 * len(ip)
+
+				if ip4 := ip.To4(); ip4 != nil {
+					ip, bits = ip4, 32
+				}
+
+				ipnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+			}
+
+			cond.nets = append(cond.nets, ipnet)
+			continue
+		}
+
+		val, err := convertField(cond.kind, lit)
+
+		if err != nil {
+			return nil, fmt.Errorf("condition \"%s\": %v", text, err)
+		}
+
+		cond.values = append(cond.values, val)
+	}
+
+	return cond, nil
+}
+
+// compareValues orders two values of the same field type.
+func compareValues(a, b interface{}) int {
+
+	switch av := a.(type) {
+	case int64:
+		bv := b.(int64)
+
+		if av < bv {
+			return -1
+		} else if av > bv {
+			return 1
+		}
+
+	case time.Duration:
+		bv := b.(time.Duration)
+
+		if av < bv {
+			return -1
+		} else if av > bv {
+			return 1
+		}
+
+	case time.Time:
+		bv := b.(time.Time)
+
+		if av.Before(bv) {
+			return -1
+		} else if av.After(bv) {
+			return 1
+		}
+
+	case string:
+		return strings.Compare(av, b.(string))
+	}
+
+	return 0
+}
+
+// holds evaluates a condition for an event. A field that is missing or did
+// not convert to its type never satisfies a condition.
+func (c *condition) holds(rmap map[string]string, typed map[string]interface{}) bool {
+	var val interface{}
+
+	if len(c.kind) > 0 {
+		v, ok := typed[c.field]
+
+		if !ok {
+			return false
+		}
+
+		val = v
+	} else {
+		v, ok := rmap[c.field]
+
+		if !ok {
+			return false
+		}
+
+		val = v
+	}
+
+	member := false
+
+	if ip, ok := val.(net.IP); ok {
+
+		for _, ipnet := range c.nets {
+
+			if ipnet.Contains(ip) {
+				member = true
+				break
+			}
+
+		}
+
+	} else {
+
+		for _, want := range c.values {
+
+			if compareValues(val, want) == 0 {
+				member = true
+				break
+			}
+
+		}
+
+	}
+
+	switch c.op {
+	case "==", "in":
+		return member
+	case "!=", "not in":
+		return !member
+	case "<":
+		return compareValues(val, c.values[0]) < 0
+	case "<=":
+		return compareValues(val, c.values[0]) <= 0
+	case ">":
+		return compareValues(val, c.values[0]) > 0
+	case ">=":
+		return compareValues(val, c.values[0]) >= 0
+	}
+
+	return false
+}
+
+// typeFields converts the fields of an event that have a declared type, once
+// it has been enriched, so that header fields and enriched keys can be typed
+// as well as captures. Fields that do not convert are left out, and only
+// remain available as strings.
+func typeFields(fil *LogFilter, rmap map[string]string) map[string]interface{} {
+	typed := make(map[string]interface{})
+
+	for name, kind := range fil.fieldTypes {
+		val, ok := rmap[name]
+
+		if !ok {
+			continue
+		}
+
+		if tv, err := convertField(kind, val); err == nil {
+			typed[name] = tv
+		}
+
+	}
+
+	return typed
+}
+
+// conditionsHold reports whether an event satisfies all of its filter's
+// Conditions.
+func conditionsHold(fil *LogFilter, rmap map[string]string, typed map[string]interface{}) bool {
+
+	for _, cond := range fil.conditions {
+
+		if !cond.holds(rmap, typed) {
+			return false
+		}
+
+	}
+
+	return true
+}
+
+// jsonValues gives typed values the form they take in JSON output: numbers
+// for integers, seconds for durations, strings for IP addresses and RFC 3339
+// strings for timestamps.
+func jsonValues(typed map[string]interface{}) map[string]interface{} {
+
+	if len(typed) == 0 {
+		return nil
+	}
+
+	out := make(map[string]interface{})
+
+	for name, val := range typed {
+
+		switch v := val.(type) {
+		case net.IP:
+			out[name] = v.String()
+		case time.Duration:
+			out[name] = v.Seconds()
+		default:
+			out[name] = v
+		}
+
+	}
+
+	return out
+}
+
+// Formatter functions for typed fields.
+
+func formatHex(val interface{}) string {
+
+	if n, ok := val.(int64); ok {
+		return fmt.Sprintf("0x%x", n)
+	}
+
+	return ""
+}
+
+func formatDec(val interface{}) string {
+
+	if n, ok := val.(int64); ok {
+		return strconv.FormatInt(n, 10)
+	}
+
+	return ""
+}
+
+func formatDate(val interface{}) string {
+
+	if t, ok := val.(time.Time); ok {
+		return t.Local().Format("2006-01-02 15:04:05")
+	}
+
+	return ""
+}
+
+func formatAgo(val interface{}) string {
+
+	if t, ok := val.(time.Time); ok {
+		return time.Since(t).Round(time.Second).String() + " ago"
+	}
+
+	return ""
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"math"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConvertField(t *testing.T) {
+	tests := []struct {
+		kind string
+		val  string
+		want interface{}
+	}{
+		{"int", "1000", int64(1000)},
+		{"int", "-5", int64(-5)},
+		{"int", "9223372036854775808", nil},
+		{"int", "ten", nil},
+		{"hex", "0x1f", int64(31)},
+		{"hex", "FF", int64(255)},
+		{"hex", "0x7fffffffffffffff", int64(math.MaxInt64)},
+		{"hex", "0x8000000000000000", nil},
+		{"hex", "ffffffffffffffff", nil},
+		{"hex", "-1", nil},
+		{"hex", "0xg", nil},
+		{"ip", "10.0.0.1", net.ParseIP("10.0.0.1")},
+		{"ip", "[::1]", net.ParseIP("::1")},
+		{"ip", "example.org", nil},
+		{"duration", "90", 90 * time.Second},
+		{"duration", "1m30s", 90 * time.Second},
+		{"duration", "soon", nil},
+		{"", "as is", "as is"},
+	}
+
+	for _, test := range tests {
+		got, err := convertField(test.kind, test.val)
+
+		if test.want == nil {
+
+			if err == nil {
+				t.Errorf("%s %q: got %v, want an error", test.kind, test.val, got)
+			}
+
+			continue
+		}
+
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s %q: got %v, %v, want %v", test.kind, test.val, got, err, test.want)
+		}
+
+	}
+
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// lineHeader is what a source's Format finds at the start of a line: the
+// time the line was logged, if it says, the header fields and the message
+// body that filters are run against.
+type lineHeader struct {
+	Time   time.Time
+	Fields map[string]string
+	Body   string
+}
+
+// A HeaderFunc parses the header of a line, or returns nil if the line does
+// not have one. Timestamps without a zone are taken to be in loc.
+type HeaderFunc func(line string, loc *time.Location) *lineHeader
+
+// A LogFormat lists the header fields its lines may have. Params is set if
+// there may also be structured data parameters, named "element.param".
+type LogFormat struct {
+	Name   string
+	Func   HeaderFunc
+	Fields []string
+	Params bool
+}
+
+var (
+	LogFormats = []LogFormat{
+		{Name: "raw", Func: parseRawHeader},
+		{Name: "rfc3164", Func: parseRFC3164Header, Fields: []string{"timestamp", "host", "program", "pid"}},
+		{Name: "rfc5424", Func: parseRFC5424Header, Fields: []string{"timestamp", "host", "program", "pid", "msgid"}, Params: true},
+		{Name: "audit", Func: parseAuditHeader, Fields: []string{"timestamp", "host", "type", "serial"}},
+		{Name: "kmsg", Func: parseKmsgHeader, Fields: []string{"timestamp", "program", "level", "seq"}}}
+)
+
+func findFormat(name string) HeaderFunc {
+
+	if lf := findLogFormat(name); lf != nil {
+		return lf.Func
+	}
+
+	return nil
+}
+
+func findLogFormat(name string) *LogFormat {
+
+	for i := 0; i < len(LogFormats); i++ {
+
+		if LogFormats[i].Name == name {
+			return &LogFormats[i]
+		}
+
+	}
+
+	return nil
+}
+
+// hasHeaderField reports whether lines of a source's Format may have a
+// header field of the given name.
+func hasHeaderField(src *LogAuditFile, name string) bool {
+	lf := findLogFormat(src.Format)
+
+	if lf == nil {
+		return false
+	}
+
+	if lf.Params && strings.Contains(name, ".") {
+		return true
+	}
+
+	for _, field := range lf.Fields {
+
+		if field == name {
+			return true
+		}
+
+	}
+
+	return false
+}
+
+// setupFormat resolves a source's Format and Timezone. Sources without a
+// Format are raw, and without a Timezone use the local one.
+func setupFormat(src *LogAuditFile) error {
+	src.location = time.Local
+
+	if len(src.Timezone) > 0 {
+		loc, err := time.LoadLocation(src.Timezone)
+
+		if err != nil {
+			return fmt.Errorf("log source \"%s\" has a bad Timezone: %v", src.Description, err)
+		}
+
+		src.location = loc
+	}
+
+	if len(src.Format) == 0 {
+		src.header = parseRawHeader
+		return nil
+	}
+
+	src.header = findFormat(src.Format)
+
+	if src.header == nil {
+		return fmt.Errorf("log source \"%s\" has unknown Format \"%s\"", src.Description, src.Format)
+	}
+
+	return nil
+}
+
+// parseHeader splits a line of a source into its header and body. A line
+// that does not have the header of the source's format, such as the second
+// line of a message that was split, is taken as it is.
+func parseHeader(src *LogAuditFile, line string) *lineHeader {
+
+	if src.header != nil {
+
+		if hdr := src.header(line, src.location); hdr != nil {
+			return hdr
+		}
+
+	}
+
+	return parseRawHeader(line, src.location)
+}
+
+func parseRawHeader(line string, loc *time.Location) *lineHeader {
+	return &lineHeader{Fields: map[string]string{}, Body: line}
+}
+
+// cutWord splits off the first space separated word of s.
+func cutWord(s string) (string, string) {
+	s = strings.TrimLeft(s, " ")
+
+	if i := strings.IndexByte(s, ' '); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+
+	return s, ""
+}
+
+// cutPriority removes the "<PRI>" a line sent over the network starts with.
+func cutPriority(line string) (string, bool) {
+
+	if !strings.HasPrefix(line, "<") {
+		return line, false
+	}
+
+	end := strings.IndexByte(line, '>')
+
+	if end < 2 || end > 4 {
+		return line, false
+	}
+
+	if _, err := strconv.Atoi(line[1:end]); err != nil {
+		return line, false
+	}
+
+	return line[end+1:], true
+}
+
+// parseRFC3164Header handles the classic syslog format written by rsyslog
+// and syslog-ng, "Mar  8 22:09:55 host prog[pid]: message", as well as its
+// variant with an RFC 3339 timestamp.
+func parseRFC3164Header(line string, loc *time.Location) *lineHeader {
+	rest, _ := cutPriority(line)
+	hdr := &lineHeader{Fields: make(map[string]string)}
+
+	if len(rest) >= len(time.Stamp) {
+
+		if t, err := parseTimestampIn(rest[:len(time.Stamp)], loc); err == nil {
+			hdr.Time = t
+			hdr.Fields["timestamp"] = rest[:len(time.Stamp)]
+			rest = rest[len(time.Stamp):]
+		}
+
+	}
+
+	if hdr.Time.IsZero() {
+		word, after := cutWord(rest)
+		t, err := time.Parse(time.RFC3339Nano, word)
+
+		if err != nil {
+			return nil
+		}
+
+		hdr.Time = t
+		hdr.Fields["timestamp"] = word
+		rest = after
+	}
+
+	hdr.Fields["host"], rest = cutWord(rest)
+
+	// The tag is the program name, maybe followed by "[pid]", up to a colon.
+	// Some messages have none.
+	tag, after := cutWord(rest)
+
+	if strings.HasSuffix(tag, ":") {
+		tag = strings.TrimSuffix(tag, ":")
+
+		if open := strings.IndexByte(tag, '['); open > 0 && strings.HasSuffix(tag, "]") {
+			hdr.Fields["pid"] = tag[open+1 : len(tag)-1]
+			tag = tag[:open]
+		}
+
+		hdr.Fields["program"] = tag
+		rest = after
+	}
+
+	hdr.Body = rest
+	return hdr
+}
+
+// parseRFC5424Header handles "<PRI>1 TIMESTAMP HOST APP PROCID MSGID [SD] MSG".
+// The parameters of structured data elements become fields named after the
+// element, such as "origin.ip".
+func parseRFC5424Header(line string, loc *time.Location) *lineHeader {
+	rest, ok := cutPriority(line)
+
+	if !ok || !strings.HasPrefix(rest, "1 ") {
+		return nil
+	}
+
+	hdr := &lineHeader{Fields: make(map[string]string)}
+	var parts [5]string
+
+	rest = rest[2:]
+
+	for i := range parts {
+		parts[i], rest = cutWord(rest)
+	}
+
+	if parts[0] != "-" {
+		t, err := time.Parse(time.RFC3339Nano, parts[0])
+
+		if err != nil {
+			return nil
+		}
+
+		hdr.Time = t
+	}
+
+	for i, name := range []string{"timestamp", "host", "program", "pid", "msgid"} {
+
+		if parts[i] != "-" {
+			hdr.Fields[name] = parts[i]
+		}
+
+	}
+
+	if strings.HasPrefix(rest, "-") {
+		rest = rest[1:]
+	} else {
+
+		for strings.HasPrefix(rest, "[") {
+			end := sdElementEnd(rest)
+
+			if end < 0 {
+				return nil
+			}
+
+			id, params := cutWord(rest[1:end])
+			elem := make(map[string]string)
+			scanKV(params, false, elem)
+
+			for key, val := range elem {
+				hdr.Fields[id+"."+key] = val
+			}
+
+			rest = rest[end+1:]
+		}
+
+	}
+
+	hdr.Body = strings.TrimPrefix(strings.TrimPrefix(rest, " "), "\xef\xbb\xbf")
+	return hdr
+}
+
+// sdElementEnd finds the "]" closing the structured data element s starts
+// with, skipping over quoted parameter values.
+func sdElementEnd(s string) int {
+	quoted := false
+
+	for i := 1; i < len(s); i++ {
+
+		switch {
+		case quoted && s[i] == '\\':
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case !quoted && s[i] == ']':
+			return i
+		}
+
+	}
+
+	return -1
+}
+
+// parseAuditHeader handles auditd records, "type=AVC msg=audit(1364481363.243:24287): ...",
+// optionally preceded by the "node=" of the host that sent them.
+func parseAuditHeader(line string, loc *time.Location) *lineHeader {
+	hdr := &lineHeader{Fields: make(map[string]string)}
+	rest := line
+
+	if strings.HasPrefix(rest, "node=") {
+		var node string
+		node, rest = cutWord(rest)
+		hdr.Fields["host"] = strings.TrimPrefix(node, "node=")
+	}
+
+	if !strings.HasPrefix(rest, "type=") {
+		return nil
+	}
+
+	var kind string
+	kind, rest = cutWord(rest)
+	hdr.Fields["type"] = strings.TrimPrefix(kind, "type=")
+
+	if !strings.HasPrefix(rest, "msg=audit(") {
+		return nil
+	}
+
+	end := strings.Index(rest, "):")
+
+	if end < 0 {
+		return nil
+	}
+
+	stamp := strings.SplitN(rest[len("msg=audit("):end], ":", 2)
+
+	if len(stamp) != 2 {
+		return nil
+	}
+
+	t, err := parseEpoch(stamp[0])
+
+	if err != nil {
+		return nil
+	}
+
+	hdr.Time = t
+	hdr.Fields["timestamp"] = stamp[0]
+	hdr.Fields["serial"] = stamp[1]
+	hdr.Body = strings.TrimPrefix(rest[end+2:], " ")
+	return hdr
+}
+
+// bootTime works out when the system was booted, in the clock kernel
+// timestamps count from. It is worked out again for every line, as the wall
+// clock may have been set since the last one.
+func bootTime() (time.Time, error) {
+	var ts unix.Timespec
+
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Now().Round(0).Add(-time.Duration(ts.Nano())), nil
+}
+
+// kernelTime converts a kernel timestamp, in seconds since boot, to wall
+// clock time.
+func kernelTime(val string) time.Time {
+	since, err := parseEpoch(val)
+
+	if err != nil {
+		return time.Time{}
+	}
+
+	boot, err := bootTime()
+
+	if err != nil {
+		return time.Time{}
+	}
+
+	return boot.Add(since.Sub(time.Unix(0, 0)))
+}
+
+// parseKmsgHeader handles the records read from /dev/kmsg,
+// "6,339,5140900,-;message", and the "[    5.140900] message" lines printed
+// by dmesg. Their timestamps are the time since boot, and are converted to
+// wall clock time using the current boot, so dmesg output saved before a
+// reboot gets the wrong time.
+func parseKmsgHeader(line string, loc *time.Location) *lineHeader {
+	hdr := &lineHeader{Fields: map[string]string{"program": "kernel"}}
+
+	if strings.HasPrefix(line, "[") {
+		end := strings.IndexByte(line, ']')
+
+		if end < 0 {
+			return nil
+		}
+
+		if _, err := strconv.ParseFloat(strings.TrimSpace(line[1:end]), 64); err != nil {
+			return nil
+		}
+
+		hdr.Fields["timestamp"] = strings.TrimSpace(line[1:end])
+		hdr.Time = kernelTime(hdr.Fields["timestamp"])
+		hdr.Body = strings.TrimPrefix(line[end+1:], " ")
+		return hdr
+	}
+
+	semi := strings.IndexByte(line, ';')
+
+	if semi < 0 {
+		return nil
+	}
+
+	prefix := strings.Split(line[:semi], ",")
+
+	if len(prefix) < 3 {
+		return nil
+	}
+
+	pri, err := strconv.Atoi(prefix[0])
+
+	if err != nil {
+		return nil
+	}
+
+	usecs, err := strconv.ParseInt(prefix[2], 10, 64)
+
+	if err != nil {
+		return nil
+	}
+
+	hdr.Fields["level"] = strconv.Itoa(pri & 7)
+	hdr.Fields["seq"] = prefix[1]
+	hdr.Fields["timestamp"] = fmt.Sprintf("%d.%06d", usecs/1e6, usecs%1e6)
+	hdr.Time = kernelTime(hdr.Fields["timestamp"])
+	hdr.Body = line[semi+1:]
+	return hdr
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Every field a header parser sets can be used in conditions and Match.
+func TestHeaderFieldsKnown(t *testing.T) {
+	lines := map[string]string{
+		"rfc3164": "Mar  8 22:09:55 subgraph kernel[42]: test",
+		"rfc5424": `<165>1 2024-03-08T22:09:55.003Z subgraph kernel 42 ID47 [origin ip="10.0.0.1"] test`,
+		"audit":   "node=subgraph type=AVC msg=audit(1520000000.123:42): test",
+		"kmsg":    "6,339,5140900,-;test",
+	}
+
+	for format, line := range lines {
+		src := &LogAuditFile{Format: format}
+
+		if err := setupFormat(src); err != nil {
+			t.Fatal(err)
+		}
+
+		hdr := parseHeader(src, line)
+
+		for field := range hdr.Fields {
+
+			if !hasHeaderField(src, field) {
+				t.Errorf("%s: the header parser sets %s, which is not in its field list", format, field)
+			}
+
+		}
+
+	}
+
+}
+
+func TestParseHeaders(t *testing.T) {
+	utc := time.UTC
+	tests := []struct {
+		format string
+		line   string
+		fields map[string]string
+		body   string
+		when   time.Time
+	}{
+		{"rfc3164", "2024-03-08T22:09:55.123456+01:00 subgraph fw-daemon[99]: DENY|example.org:443",
+			map[string]string{"timestamp": "2024-03-08T22:09:55.123456+01:00", "host": "subgraph", "program": "fw-daemon", "pid": "99"},
+			"DENY|example.org:443", time.Date(2024, 3, 8, 21, 9, 55, 123456000, utc)},
+		{"rfc3164", "<38>2024-03-08T22:09:55Z subgraph sshd[1234]: Accepted publickey for user",
+			map[string]string{"timestamp": "2024-03-08T22:09:55Z", "host": "subgraph", "program": "sshd", "pid": "1234"},
+			"Accepted publickey for user", time.Date(2024, 3, 8, 22, 9, 55, 0, utc)},
+		{"rfc3164", "2024-03-08T22:09:55Z subgraph -- MARK --",
+			map[string]string{"timestamp": "2024-03-08T22:09:55Z", "host": "subgraph"},
+			"-- MARK --", time.Date(2024, 3, 8, 22, 9, 55, 0, utc)},
+		{"rfc3164", "kernel: grsec: denied", nil, "", time.Time{}},
+		{"rfc3164", "", nil, "", time.Time{}},
+
+		{"rfc5424", `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="Application"][origin ip="10.0.0.1"] An application event`,
+			map[string]string{"timestamp": "2003-10-11T22:14:15.003Z", "host": "mymachine.example.com", "program": "evntslog", "msgid": "ID47",
+				"exampleSDID@32473.iut": "3", "exampleSDID@32473.eventSource": "Application", "origin.ip": "10.0.0.1"},
+			"An application event", time.Date(2003, 10, 11, 22, 14, 15, 3000000, utc)},
+		{"rfc5424", `<34>1 2003-10-11T22:14:15.003Z mymachine su 77 - - 'su root' failed for lonvick on /dev/pts/8`,
+			map[string]string{"timestamp": "2003-10-11T22:14:15.003Z", "host": "mymachine", "program": "su", "pid": "77"},
+			"'su root' failed for lonvick on /dev/pts/8", time.Date(2003, 10, 11, 22, 14, 15, 3000000, utc)},
+		{"rfc5424", `<34>1 - - - - - - message without a header`,
+			map[string]string{}, "message without a header", time.Time{}},
+		{"rfc5424", `<34>1 2003-10-11 mymachine su - - - bad timestamp`, nil, "", time.Time{}},
+		{"rfc5424", `<34>1 2003-10-11T22:14:15Z mymachine su - - [origin ip="10.0.0.1" unterminated`, nil, "", time.Time{}},
+		{"rfc5424", `<34>2 2003-10-11T22:14:15Z mymachine su - - - wrong version`, nil, "", time.Time{}},
+		{"rfc5424", `Oct 11 22:14:15 mymachine su: rfc3164`, nil, "", time.Time{}},
+
+		{"audit", `type=AVC msg=audit(1364481363.243:24287): apparmor="DENIED" operation="open"`,
+			map[string]string{"type": "AVC", "timestamp": "1364481363.243", "serial": "24287"},
+			`apparmor="DENIED" operation="open"`, time.Unix(1364481363, 243000000)},
+		{"audit", `node=subgraph type=SECCOMP msg=audit(1364481363.000000001:7): auid=1000`,
+			map[string]string{"host": "subgraph", "type": "SECCOMP", "timestamp": "1364481363.000000001", "serial": "7"},
+			"auid=1000", time.Unix(1364481363, 1)},
+		{"audit", `type=AVC msg=audit(1364481363.243): no serial`, nil, "", time.Time{}},
+		{"audit", `type=AVC msg=audit(soon:1): bad time`, nil, "", time.Time{}},
+		{"audit", `type=AVC msg=audit(1364481363.243:1) unterminated`, nil, "", time.Time{}},
+		{"audit", `node=subgraph apparmor="DENIED"`, nil, "", time.Time{}},
+	}
+
+	for _, test := range tests {
+		src := &LogAuditFile{Format: test.format, Timezone: "UTC"}
+
+		if err := setupFormat(src); err != nil {
+			t.Fatal(err)
+		}
+
+		hdr := findFormat(test.format)(test.line, src.location)
+
+		if test.fields == nil {
+
+			if hdr != nil {
+				t.Errorf("%s %q: malformed header parsed as %+v", test.format, test.line, hdr)
+			}
+
+			continue
+		}
+
+		if hdr == nil {
+			t.Errorf("%s %q: not parsed", test.format, test.line)
+			continue
+		}
+
+		if !reflect.DeepEqual(hdr.Fields, test.fields) {
+			t.Errorf("%s %q: got fields %v, want %v", test.format, test.line, hdr.Fields, test.fields)
+		}
+
+		if hdr.Body != test.body {
+			t.Errorf("%s %q: got body %q, want %q", test.format, test.line, hdr.Body, test.body)
+		}
+
+		if !hdr.Time.Equal(test.when) {
+			t.Errorf("%s %q: got time %v, want %v", test.format, test.line, hdr.Time, test.when)
+		}
+
+	}
+
+}
+
+// Syslog timestamps lack a year; they are given the one that puts them
+// closest before now.
+func TestParseRFC3164Stamp(t *testing.T) {
+	hdr := parseRFC3164Header("Mar  8 22:09:55 subgraph kernel: [ 5140.900123] grsec: denied", time.UTC)
+
+	if hdr == nil {
+		t.Fatal("not parsed")
+	}
+
+	want := map[string]string{"timestamp": "Mar  8 22:09:55", "host": "subgraph", "program": "kernel"}
+
+	if !reflect.DeepEqual(hdr.Fields, want) || hdr.Body != "[ 5140.900123] grsec: denied" {
+		t.Errorf("got fields %v and body %q", hdr.Fields, hdr.Body)
+	}
+
+	if hdr.Time.Month() != time.March || hdr.Time.Day() != 8 || hdr.Time.Hour() != 22 {
+		t.Errorf("got time %v", hdr.Time)
+	}
+
+	if now := time.Now(); hdr.Time.After(now.Add(24*time.Hour)) || hdr.Time.Before(now.AddDate(-1, 0, -1)) {
+		t.Errorf("got time %v, more than a year before or after now", hdr.Time)
+	}
+
+}
+
+func TestInferYear(t *testing.T) {
+	stamp := func(val string) time.Time {
+		ts, err := time.ParseInLocation(time.Stamp, val, time.UTC)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return ts
+	}
+	at := func(year int, month time.Month, day, hour, min int) time.Time {
+		return time.Date(year, month, day, hour, min, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		line string
+		now  time.Time
+		want time.Time
+	}{
+		// Late December read in early January is from last year.
+		{"Dec 31 23:59:00", at(2025, time.January, 1, 0, 10), at(2024, time.December, 31, 23, 59)},
+		{"Dec 24 12:00:00", at(2025, time.January, 6, 9, 0), at(2024, time.December, 24, 12, 0)},
+		// Early January read on New Year's Eve, with the clock slightly
+		// behind, is from the coming year.
+		{"Jan  1 00:30:00", at(2024, time.December, 31, 23, 50), at(2025, time.January, 1, 0, 30)},
+		{"Jan  1 00:30:00", at(2024, time.December, 30, 12, 0), at(2024, time.January, 1, 0, 30)},
+		{"Mar  8 22:09:00", at(2025, time.March, 8, 12, 0), at(2025, time.March, 8, 22, 9)},
+		{"Mar 10 22:09:00", at(2025, time.March, 8, 12, 0), at(2024, time.March, 10, 22, 9)},
+		{"Feb 29 12:00:00", at(2024, time.March, 1, 0, 0), at(2024, time.February, 29, 12, 0)},
+		{"Feb 29 12:00:00", at(2025, time.March, 1, 0, 0), at(2024, time.February, 29, 12, 0)},
+	}
+
+	for _, test := range tests {
+
+		if got := inferYear(stamp(test.line), test.now); !got.Equal(test.want) {
+			t.Errorf("%s read at %v: got %v, want %v", test.line, test.now, got, test.want)
+		}
+
+	}
+
+}
+
+func TestParseEpoch(t *testing.T) {
+	tests := []struct {
+		val  string
+		secs int64
+		nsec int64
+		ok   bool
+	}{
+		{"1364481363.243", 1364481363, 243000000, true},
+		{"1364481363", 1364481363, 0, true},
+		{"5.140900", 5, 140900000, true},
+		{"1.000000001", 1, 1, true},
+		{"0.999999999", 0, 999999999, true},
+		{"-5", -5, 0, true},
+		{"+5", 0, 0, false},
+		{"1.", 0, 0, false},
+		{"1.1234567890", 0, 0, false},
+		{"1.2a", 0, 0, false},
+		{"1.-2", 0, 0, false},
+		{"soon", 0, 0, false},
+		{"", 0, 0, false},
+	}
+
+	for _, test := range tests {
+		got, err := parseEpoch(test.val)
+
+		if (err == nil) != test.ok {
+			t.Errorf("%q: got error %v", test.val, err)
+			continue
+		}
+
+		if test.ok && !got.Equal(time.Unix(test.secs, test.nsec)) {
+			t.Errorf("%q: got %v, want %v", test.val, got, time.Unix(test.secs, test.nsec))
+		}
+
+	}
+
+}
+
+// Kernel timestamps count from boot; they are converted to wall clock time
+// as of the current boot.
+func TestParseKmsgHeader(t *testing.T) {
+	tests := []struct {
+		line   string
+		fields map[string]string
+		body   string
+	}{
+		{"6,339,5140900,-;grsec: denied resource overstep",
+			map[string]string{"program": "kernel", "level": "6", "seq": "339", "timestamp": "5.140900"},
+			"grsec: denied resource overstep"},
+		{"12,1,0,-,caller=T1;audit: type=1400",
+			map[string]string{"program": "kernel", "level": "4", "seq": "1", "timestamp": "0.000000"},
+			"audit: type=1400"},
+		{"[ 5140.900123] grsec: From 10.0.0.1",
+			map[string]string{"program": "kernel", "timestamp": "5140.900123"},
+			"grsec: From 10.0.0.1"},
+		{"6,339;no timestamp", nil, ""},
+		{"x,339,5140900,-;bad level", nil, ""},
+		{"6,339,soon,-;bad timestamp", nil, ""},
+		{"[soon] bad timestamp", nil, ""},
+		{"[ 5140.900123 unterminated", nil, ""},
+		{"no header at all", nil, ""},
+	}
+
+	for _, test := range tests {
+		hdr := parseKmsgHeader(test.line, time.UTC)
+
+		if test.fields == nil {
+
+			if hdr != nil {
+				t.Errorf("%q: malformed header parsed as %+v", test.line, hdr)
+			}
+
+			continue
+		}
+
+		if hdr == nil {
+			t.Errorf("%q: not parsed", test.line)
+			continue
+		}
+
+		if !reflect.DeepEqual(hdr.Fields, test.fields) || hdr.Body != test.body {
+			t.Errorf("%q: got fields %v and body %q", test.line, hdr.Fields, hdr.Body)
+		}
+
+		boot, err := bootTime()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		since, _ := parseEpoch(test.fields["timestamp"])
+		want := boot.Add(since.Sub(time.Unix(0, 0)))
+
+		if d := hdr.Time.Sub(want); d < -time.Second || d > time.Second {
+			t.Errorf("%q: got time %v, want about %v", test.line, hdr.Time, want)
+		}
+
+	}
+
+}
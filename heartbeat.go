@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+var startTime = time.Now()
+
+// checkSilence raises an alert for every source with a MaxSilence that has
+// not produced a line for that long, and an all-clear once it does again.
+// A quiet audit.log usually means auditd has died, which is exactly the kind
+// of thing a security monitor must not keep quiet about.
+func checkSilence(now time.Time) {
+
+	for i := 0; i < len(AuditLogs); i++ {
+		src := &AuditLogs[i]
+
+		if src.maxSilence == 0 || src.silent {
+			continue
+		}
+
+		if now.Sub(src.lastLine) < src.maxSilence {
+			continue
+		}
+
+		src.silent = true
+		meta := map[string]string{"source": sourceLabel(src), "logfile": src.PathName, "maxsilence": src.MaxSilence}
+		emitInternal("source-silent", "alert", fmt.Sprintf("no lines from %s in over %s", src.Description, src.MaxSilence), meta)
+	}
+
+}
+
+// noteLine records that a source has just produced a line.
+func noteLine(src *LogAuditFile) {
+	src.lastLine = time.Now()
+
+	if src.silent {
+		src.silent = false
+		meta := map[string]string{"source": sourceLabel(src), "logfile": src.PathName}
+		emitInternal("source-silence-ended", "info", fmt.Sprintf("%s is producing lines again", src.Description), meta)
+	}
+
+}
+
+// sendHeartbeat tells the event notifier that sublogmon is still alive. It is
+// only sent over D-Bus, as a com.subgraph.sublogmon.Heartbeat signal straight
+// on the system bus rather than through the event sinks, so it goes out even
+// if no notifier was there to take events; the interval is included so that
+// the receiving end knows when to start worrying. A heartbeat that cannot be
+// sent counts as a D-Bus failure.
+func sendHeartbeat(interval time.Duration) {
+	active := 0
+
+	for i := 0; i < len(AuditLogs); i++ {
+
+		if AuditLogs[i].status == SOURCE_ACTIVE {
+			active++
+		}
+
+	}
+
+	meta := map[string]string{
+		"pid":      strconv.Itoa(os.Getpid()),
+		"uptime":   strconv.FormatInt(int64(time.Since(startTime).Seconds()), 10),
+		"interval": strconv.FormatInt(int64(interval.Seconds()), 10),
+		"sources":  strconv.Itoa(len(AuditLogs)),
+		"active":   strconv.Itoa(active),
+	}
+
+	if err := emitHeartbeat(meta); err != nil {
+		metrics.countDbusFailure()
+	}
+
+}
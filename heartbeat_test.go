@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// The heartbeat goes out on its own, with no event notifier or other sink
+// to carry it.
+func TestHeartbeatWithoutNotifier(t *testing.T) {
+	var sent []map[string]string
+	emit := emitHeartbeat
+	emitHeartbeat = func(metadata map[string]string) error {
+		sent = append(sent, metadata)
+		return nil
+	}
+
+	defer func() { emitHeartbeat = emit }()
+
+	sinks = nil
+	AuditLogs = []LogAuditFile{{SourceName: "a", status: SOURCE_ACTIVE}, {SourceName: "b"}}
+	defer func() { AuditLogs = nil }()
+
+	sendHeartbeat(time.Minute)
+
+	if len(sent) != 1 {
+		t.Fatalf("got %d heartbeats, want 1", len(sent))
+	}
+
+	want := map[string]string{"pid": strconv.Itoa(os.Getpid()), "interval": "60", "sources": "2", "active": "1"}
+
+	for key, val := range want {
+
+		if sent[0][key] != val {
+			t.Errorf("got %s %q, want %q", key, sent[0][key], val)
+		}
+
+	}
+
+	emitHeartbeat = func(map[string]string) error { return errors.New("no system bus") }
+	failures := metrics.dbusFailures
+	sendHeartbeat(time.Minute)
+
+	if metrics.dbusFailures != failures+1 {
+		t.Error("a heartbeat that could not be sent was not counted as a D-Bus failure")
+	}
+
+}
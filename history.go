@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HISTORY_SEGMENT_SIZE is how large a history segment may grow before a new
+// one is started. Retention works on whole segments.
+const HISTORY_SEGMENT_SIZE = 4 * 1024 * 1024
+
+// HISTORY_AGE_SLICES is how many segments the maximum age is split into: a
+// segment is closed once it is that fraction of the maximum age old, even if
+// it is not full, so that on a quiet host old events still end up in a
+// segment that can be removed. Events are thus kept for up to a tenth longer
+// than the maximum age.
+const HISTORY_AGE_SLICES = 10
+
+const HISTORY_SEGMENT_PREFIX = "events-"
+const HISTORY_SEGMENT_SUFFIX = ".jsonl"
+
+// historyRecord is how an event is kept in the history store, one JSON
+// object per line.
+type historyRecord struct {
+	Time         time.Time
+	ObservedTime time.Time
+	EventID      string
+	Severity     string
+	Source       string
+	Output       string
+	LogLine      string
+	OrigLogLine  string
+	Metadata     map[string]string
+	Values       map[string]interface{} `json:",omitempty"`
+}
+
+// historyStore is the sink that keeps every event in a directory of
+// JSON-lines segments, for "sublogmon query" to search later.
+type historyStore struct {
+	sync.Mutex
+	dir     string
+	maxSize int64
+	maxAge  time.Duration
+	segSize int64
+	f       *os.File
+	size    int64
+	opened  time.Time
+}
+
+func newHistoryStore(dir string, maxSize int64, maxAge time.Duration) (*historyStore, error) {
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	hs := &historyStore{dir: dir, maxSize: maxSize, maxAge: maxAge, segSize: HISTORY_SEGMENT_SIZE}
+
+	// Keep at least a few segments within the size limit, so that expiring
+	// the oldest one does not throw away most of the history at once.
+	if maxSize > 0 && hs.segSize > maxSize/4 {
+		hs.segSize = maxSize / 4
+	}
+
+	hs.expire()
+
+	if maxAge > 0 {
+
+		go func() {
+
+			for range time.Tick(maxAge / HISTORY_AGE_SLICES) {
+				hs.tidy()
+			}
+
+		}()
+
+	}
+
+	return hs, nil
+}
+
+// segmentOld reports whether the current segment has been written to for
+// long enough to be closed.
+func (hs *historyStore) segmentOld() bool {
+	return hs.maxAge > 0 && time.Since(hs.opened) >= hs.maxAge/HISTORY_AGE_SLICES
+}
+
+// tidy closes the current segment if it is old enough, and applies the
+// retention limits. It runs regularly, so that segments expire even when no
+// events come in.
+func (hs *historyStore) tidy() {
+	hs.Lock()
+	defer hs.Unlock()
+
+	if hs.f != nil && hs.segmentOld() {
+		hs.f.Close()
+		hs.f = nil
+	}
+
+	hs.expire()
+}
+
+func (hs *historyStore) Name() string {
+	return "history store"
+}
+
+func (hs *historyStore) Send(ev *logEvent) error {
+	rec := historyRecord{time.Unix(0, ev.Timestamp), time.Unix(0, ev.ObservedTimestamp), ev.EventID, ev.LogLevel, ev.Source, ev.Output, ev.LogLine, ev.OrigLogLine, ev.Metadata, jsonValues(ev.Typed)}
+	data, err := json.Marshal(rec)
+
+	if err != nil {
+		return err
+	}
+
+	data = append(data, '\n')
+	hs.Lock()
+	defer hs.Unlock()
+
+	if hs.f == nil || hs.size+int64(len(data)) > hs.segSize || hs.segmentOld() {
+
+		if err = hs.rotate(); err != nil {
+			return err
+		}
+
+	}
+
+	n, err := hs.f.Write(data)
+	hs.size += int64(n)
+	return err
+}
+
+// rotate starts a new segment and applies the retention limits.
+func (hs *historyStore) rotate() error {
+
+	if hs.f != nil {
+		hs.f.Close()
+		hs.f = nil
+	}
+
+	name := fmt.Sprintf("%s%020d%s", HISTORY_SEGMENT_PREFIX, time.Now().UnixNano(), HISTORY_SEGMENT_SUFFIX)
+	f, err := os.OpenFile(filepath.Join(hs.dir, name), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	hs.f = f
+	hs.size = 0
+	hs.opened = time.Now()
+	hs.expire()
+	return nil
+}
+
+// historySegments lists the segments in a history directory, oldest first.
+func historySegments(dir string) ([]string, error) {
+	segs, err := filepath.Glob(filepath.Join(dir, HISTORY_SEGMENT_PREFIX+"*"+HISTORY_SEGMENT_SUFFIX))
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(segs)
+	return segs, nil
+}
+
+// expire removes segments that are past the maximum age, then the oldest
+// ones until the store fits in its size limit. The segment being written to
+// is never removed.
+func (hs *historyStore) expire() {
+	segs, err := historySegments(hs.dir)
+
+	if err != nil {
+		return
+	}
+
+	var current string
+
+	if hs.f != nil {
+		current = hs.f.Name()
+	}
+
+	var keep []os.FileInfo
+	var total int64
+
+	for _, seg := range segs {
+		fi, err := os.Stat(seg)
+
+		if err != nil {
+			continue
+		}
+
+		if seg != current && hs.maxAge > 0 && time.Since(fi.ModTime()) > hs.maxAge {
+			os.Remove(seg)
+			continue
+		}
+
+		keep = append(keep, fi)
+		total += fi.Size()
+	}
+
+	for i := 0; i < len(keep) && hs.maxSize > 0 && total > hs.maxSize; i++ {
+		seg := filepath.Join(hs.dir, keep[i].Name())
+
+		if seg == current {
+			break
+		}
+
+		if os.Remove(seg) == nil {
+			total -= keep[i].Size()
+		}
+
+	}
+
+}
+
+// readHistory calls fn for every record in a history directory, oldest
+// first. Lines that cannot be decoded, such as one cut short by a crash, are
+// skipped, but a segment that cannot be read to its end, or has a line too
+// long to hold, is an error rather than being silently cut short.
+func readHistory(dir string, fn func(rec *historyRecord)) error {
+	segs, err := historySegments(dir)
+
+	if err != nil {
+		return err
+	}
+
+	for _, seg := range segs {
+		f, err := os.Open(seg)
+
+		if err != nil {
+
+			// Expired while being read.
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			return err
+		}
+
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, BUFSIZE), 1024*1024)
+
+		for scanner.Scan() {
+			var rec historyRecord
+
+			if json.Unmarshal(scanner.Bytes(), &rec) == nil {
+				fn(&rec)
+			}
+
+		}
+
+		err = scanner.Err()
+		f.Close()
+
+		if err != nil {
+			return fmt.Errorf("%s: %v", seg, err)
+		}
+
+	}
+
+	return nil
+}
+
+// parseHistoryTime accepts an absolute time (RFC 3339, or a date) or a
+// duration meaning that long ago.
+func parseHistoryTime(val string) (time.Time, error) {
+
+	if d, err := time.ParseDuration(val); err == nil {
+		return time.Now().Add(-d), nil
+	}
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"} {
+
+		if t, err := time.ParseInLocation(layout, val, time.Local); err == nil {
+			return t, nil
+		}
+
+	}
+
+	return time.Time{}, fmt.Errorf("cannot parse time \"%s\"", val)
+}
+
+// historyQuery selects records from the history store. Empty fields match
+// anything; ID and source match exactly, metadata values by substring.
+type historyQuery struct {
+	since    time.Time
+	until    time.Time
+	id       string
+	severity string
+	source   string
+	fields   map[string]string
+}
+
+func (q *historyQuery) matches(rec *historyRecord) bool {
+
+	if !q.since.IsZero() && rec.Time.Before(q.since) {
+		return false
+	}
+
+	if !q.until.IsZero() && rec.Time.After(q.until) {
+		return false
+	}
+
+	if len(q.id) > 0 && rec.EventID != q.id {
+		return false
+	}
+
+	if len(q.severity) > 0 && rec.Severity != q.severity {
+		return false
+	}
+
+	if len(q.source) > 0 && rec.Source != q.source {
+		return false
+	}
+
+	for key, val := range q.fields {
+		mval, ok := rec.Metadata[key]
+
+		if !ok || !strings.Contains(mval, val) {
+			return false
+		}
+
+	}
+
+	return true
+}
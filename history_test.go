@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadHistory(t *testing.T) {
+	dir := t.TempDir()
+	seg := filepath.Join(dir, HISTORY_SEGMENT_PREFIX+"20260308-220955"+HISTORY_SEGMENT_SUFFIX)
+	data := `{"EventID":"first"}
+{"EventID":"cut sh
+{"EventID":"second"}
+`
+
+	if err := ioutil.WriteFile(seg, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+
+	if err := readHistory(dir, func(rec *historyRecord) { ids = append(ids, rec.EventID) }); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(ids, ",") != "first,second" {
+		t.Errorf("got %v, want [first second]", ids)
+	}
+
+}
+
+// A line longer than the scanner can hold must not end the read silently, as
+// if the rest of the history were not there.
+func TestReadHistoryLongLine(t *testing.T) {
+	dir := t.TempDir()
+	seg := filepath.Join(dir, HISTORY_SEGMENT_PREFIX+"20260308-220955"+HISTORY_SEGMENT_SUFFIX)
+	data := `{"EventID":"first"}` + "\n" + `{"EventID":"` + strings.Repeat("x", 2*1024*1024) + `"}` + "\n" + `{"EventID":"last"}` + "\n"
+
+	if err := ioutil.WriteFile(seg, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := readHistory(dir, func(rec *historyRecord) {}); err == nil {
+		t.Error("reading a segment with an over-long line did not fail")
+	}
+
+}
+
+// On a quiet host the segment being written to never fills up; it is still
+// closed and removed once its events are past the maximum age.
+func TestHistoryAgeExpiry(t *testing.T) {
+	dir := t.TempDir()
+	hs := &historyStore{dir: dir, maxAge: time.Hour, segSize: HISTORY_SEGMENT_SIZE}
+	now := time.Now().UnixNano()
+
+	if err := hs.Send(&logEvent{slmData: slmData{EventID: "old", Timestamp: now, ObservedTimestamp: now}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pretend the event was written two hours ago.
+	old := time.Now().Add(-2 * time.Hour)
+	hs.opened = old
+
+	if err := os.Chtimes(hs.f.Name(), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	hs.tidy()
+	var ids []string
+
+	if err := readHistory(dir, func(rec *historyRecord) { ids = append(ids, rec.EventID) }); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ids) != 0 {
+		t.Errorf("got %v, want the expired event gone", ids)
+	}
+
+	if err := hs.Send(&logEvent{slmData: slmData{EventID: "new", Timestamp: now, ObservedTimestamp: now}}); err != nil {
+		t.Fatal(err)
+	}
+
+	hs.tidy()
+
+	if err := readHistory(dir, func(rec *historyRecord) { ids = append(ids, rec.EventID) }); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(ids, ",") != "new" {
+		t.Errorf("got %v, want [new]", ids)
+	}
+
+}
+
+// A segment is closed for writing once it is a slice of the maximum age old,
+// so that it can expire as a whole.
+func TestHistoryRotatesByAge(t *testing.T) {
+	dir := t.TempDir()
+	hs := &historyStore{dir: dir, maxAge: time.Hour, segSize: HISTORY_SEGMENT_SIZE}
+	now := time.Now().UnixNano()
+	ev := &logEvent{slmData: slmData{EventID: "a", Timestamp: now, ObservedTimestamp: now}}
+
+	if err := hs.Send(ev); err != nil {
+		t.Fatal(err)
+	}
+
+	first := hs.f.Name()
+	hs.opened = time.Now().Add(-time.Hour / HISTORY_AGE_SLICES)
+	time.Sleep(time.Millisecond)
+
+	if err := hs.Send(ev); err != nil {
+		t.Fatal(err)
+	}
+
+	if hs.f.Name() == first {
+		t.Error("an old segment was written to rather than a new one started")
+	}
+
+	hs.f.Close()
+}
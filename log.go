@@ -6,21 +6,32 @@ import "os"
 import "regexp"
 import "strings"
 import "strconv"
-import "io/ioutil"
-import "encoding/json"
+import "os/signal"
+import "syscall"
+import "time"
 import "flag"
 import "path/filepath"
-import "time"
 
 //import fsnotify "gopkg.in/fsnotify.v1"
 import inotify "github.com/subgraph/inotify"
 
 var colorsMap = map[string]string{
-	"ANSI_COLOR_RED":      "\033[0;31m",
-	"ANSI_COLOR_RED_BOLD": "\033[1;31m",
-	"ANSI_COLOR_GREEN":    "\033[0;32m",
-	"ANSI_COLOR_YELLOW":   "\033[0;33m",
-	"ANSI_COLOR_RESET":    "\033[0m",
+	"ANSI_COLOR_BOLD":         "\033[1m",
+	"ANSI_COLOR_RED":          "\033[0;31m",
+	"ANSI_COLOR_RED_BOLD":     "\033[1;31m",
+	"ANSI_COLOR_GREEN":        "\033[0;32m",
+	"ANSI_COLOR_GREEN_BOLD":   "\033[1;32m",
+	"ANSI_COLOR_YELLOW":       "\033[0;33m",
+	"ANSI_COLOR_YELLOW_BOLD":  "\033[1;33m",
+	"ANSI_COLOR_BLUE":         "\033[0;34m",
+	"ANSI_COLOR_BLUE_BOLD":    "\033[1;34m",
+	"ANSI_COLOR_MAGENTA":      "\033[0;35m",
+	"ANSI_COLOR_MAGENTA_BOLD": "\033[1;35m",
+	"ANSI_COLOR_CYAN":         "\033[0;36m",
+	"ANSI_COLOR_CYAN_BOLD":    "\033[1;36m",
+	"ANSI_COLOR_WHITE":        "\033[0;37m",
+	"ANSI_COLOR_WHITE_BOLD":   "\033[1;37m",
+	"ANSI_COLOR_RESET":        "\033[0m",
 }
 
 const AUDIT_LOG_FILE = "/var/log/audit/audit.log"
@@ -29,33 +40,72 @@ const BUFSIZE = 4096
 
 type LogFunc func(string) string
 
+// A TypedLogFunc formats the value of a field with a declared type.
+type TypedLogFunc func(interface{}) string
+
 type LogFunction struct {
-	FuncName string
-	Func     LogFunc
+	FuncName  string
+	Func      LogFunc
+	TypedFunc TypedLogFunc
 }
 
 type LogFilter struct {
-	ID         string
-	Regexp     string
-	Fields     []string
-	OutputStr  string
-	OutputAttr string
-	Severity string
-	Regcomp    *regexp.Regexp
+	ID            string
+	Regexp        string            `json:",omitempty"`
+	Parser        string            `json:",omitempty"`
+	Match         map[string]string `json:",omitempty"`
+	Contains      string            `json:",omitempty"`
+	Fields        []string          `json:",omitempty"`
+	OutputStr     string
+	OutputTitle   string         `json:",omitempty"`
+	OutputBody    string         `json:",omitempty"`
+	OutputConsole string         `json:",omitempty"`
+	OutputSyslog  string         `json:",omitempty"`
+	OutputAttr    string         `json:",omitempty"`
+	Severity      string         `json:",omitempty"`
+	Tags          []string       `json:",omitempty"`
+	Conditions    []string       `json:",omitempty"`
+	Continue      bool           `json:",omitempty"`
+	Enrich        []string       `json:",omitempty"`
+	Exec          *ExecAction    `json:",omitempty"`
+	Regcomp       *regexp.Regexp `json:"-"`
+	containsID    int
+	enrichers     []EnrichFunc
+	fieldTypes    map[string]string
+	conditions    []*condition
+	parse         ParseFunc
+	matchRegcomp  map[string]*regexp.Regexp
 }
 
 type LogAuditFile struct {
 	Description string
 	SourceName  string
 	PathName    string
+	Format      string `json:",omitempty"`
+	Timezone    string `json:",omitempty"`
+	MaxSilence  string `json:",omitempty"`
 	Filters     []LogFilter
-	f           *os.File
-	Backlog     string
+	header      HeaderFunc
+	location    *time.Location
+	tails       map[string]*logTail
+	lost        map[string]tailState
+	prefilter   *acMatcher
+	status      string
+	retryAt     time.Time
+	retryDelay  time.Duration
+	announced   string
+	rotatedAt   time.Time
+	maxSilence  time.Duration
+	lastLine    time.Time
+	silent      bool
 }
 
 type LogSuppression struct {
-        Description string
-        Metadata map[string]string
+	Description string
+	Wildcard    string
+	Metadata    map[string]string
+	Regcomp     *regexp.Regexp
+	MetaRegcomp map[string]*regexp.Regexp
 }
 
 var AuditLogs []LogAuditFile
@@ -63,7 +113,11 @@ var Suppressions []LogSuppression
 
 var (
 	LogFunctions = []LogFunction{
-		{FuncName: "getscname", Func: getSyscallByNumber}}
+		{FuncName: "getscname", Func: getSyscallByNumber},
+		{FuncName: "hex", TypedFunc: formatHex},
+		{FuncName: "dec", TypedFunc: formatDec},
+		{FuncName: "date", TypedFunc: formatDate},
+		{FuncName: "ago", TypedFunc: formatAgo}}
 )
 
 func getSyscallByNumber(data string) string {
@@ -109,7 +163,7 @@ func testRegexp(logIndex int, filterIndex int, expression string) {
 	}
 
 	for i := 0; i < len(AuditLogs[logIndex].Filters[filterIndex].Fields); i++ {
-		fstr := AuditLogs[logIndex].Filters[filterIndex].Fields[i]
+		fstr, _, _ := splitFieldSpec(AuditLogs[logIndex].Filters[filterIndex].Fields[i])
 		fmt.Printf("Extracting field: %s = \"%s\"\n", fstr, rmap[fstr])
 	}
 
@@ -119,16 +173,18 @@ func testRegexp(logIndex int, filterIndex int, expression string) {
 		fmt.Println("*** No output string was returned.")
 	} else {
 
-		if len(AuditLogs[logIndex].Filters[filterIndex].OutputAttr) > 0 {
-			outstr = AuditLogs[logIndex].Filters[filterIndex].OutputAttr + outstr + colorsMap["ANSI_COLOR_RESET"]
-		}
-
-		fmt.Println("OUTPUT: ", outstr)
+		fmt.Println("OUTPUT: ", colorize(eventColor(&AuditLogs[logIndex].Filters[filterIndex]), outstr))
 	}
 
 }
 
 func formatOutput(src string, strMap map[string]string) string {
+	return formatTyped(src, strMap, nil)
+}
+
+// formatTyped is formatOutput for events with typed fields, whose functions
+// get the typed value where they can take one.
+func formatTyped(src string, strMap map[string]string, typed map[string]interface{}) string {
 	retstr := src
 
 	for key, val := range strMap {
@@ -165,7 +221,15 @@ func formatOutput(src string, strMap map[string]string) string {
 				for i := 0; i < len(LogFunctions); i++ {
 
 					if LogFunctions[i].FuncName == custFuncName {
-						replaced = LogFunctions[i].Func(replaced)
+						tval, ok := typed[key]
+
+						if ok && LogFunctions[i].TypedFunc != nil {
+							replaced = LogFunctions[i].TypedFunc(tval)
+						} else if LogFunctions[i].Func != nil {
+							replaced = LogFunctions[i].Func(replaced)
+						} else {
+							replaced = ""
+						}
 
 						if len(replaced) == 0 {
 							replaced = val
@@ -190,22 +254,76 @@ func formatOutput(src string, strMap map[string]string) string {
 var progName string
 
 func usage() {
-	fmt.Fprintln(os.Stderr, "Usage: "+progName+" [-h/-help] [-d/-debug] [-c/-config json_config] [-s/-suppress json_config]     where")
+	fmt.Fprintln(os.Stderr, "Usage: "+progName+" [-h/-help] [-d/-debug] [-c/-config json_config] [-confdir dir] [-dump-config] [-s/-suppress json_config] [-metrics addr] [-state file] [-shutdown-timeout duration] [-heartbeat duration] [-syslog] [-tui] [-color mode] [-severity-colors list] [-history dir] [-history-max-size MB] [-history-max-age duration] [-tor-exits file] [-blocklist file] [-exec-max n] [-notify mode] [-digest-to addrs] [-digest-interval duration] [-digest-from addr] [-digest-immediate] [-smtp host:port] [-sendmail path]     where\n       "+progName+" query [options]     to search the event history (see \""+progName+" query -h\")")
 	fmt.Fprintln(os.Stderr, "  -c / -config:     specifies a custom json config file (\"sublogmon.json\" by default),")
+	fmt.Fprintln(os.Stderr, "  -confdir:         specifies a directory of drop-in json config files to merge in (\"sublogmon.d\" by default),")
+	fmt.Fprintln(os.Stderr, "  -dump-config:     prints the merged log source config and exits,")
 	fmt.Fprintln(os.Stderr, "  -s / -suppress:   specifies a custom log suppression file (\"suppressions.json\" by default),")
 	fmt.Fprintln(os.Stderr, "  -d / -debug:      dumps additional debug information to stderr,")
+	fmt.Fprintln(os.Stderr, "  -metrics:         serves metrics over HTTP on this localhost address (e.g. \"127.0.0.1:9273\"),")
+	fmt.Fprintln(os.Stderr, "  -state:           specifies where read positions are saved on exit (\"sublogmon.state\" by default, \"\" to disable),")
+	fmt.Fprintln(os.Stderr, "  -shutdown-timeout: maximum time to spend shutting down (5s by default),")
+	fmt.Fprintln(os.Stderr, "  -heartbeat:       interval between D-Bus heartbeat signals (off by default),")
+	fmt.Fprintln(os.Stderr, "  -syslog:          also sends events to syslog (authpriv facility),")
+	fmt.Fprintln(os.Stderr, "  -tui:             shows events on a full-screen dashboard instead of printing them,")
+	fmt.Fprintln(os.Stderr, "  -color:           auto, always or never (\"auto\" by default: only on a terminal, and not if NO_COLOR is set),")
+	fmt.Fprintln(os.Stderr, "  -severity-colors: colors for events whose filter has no OutputAttr (e.g. \"alert=ANSI_COLOR_MAGENTA,info=ANSI_COLOR_CYAN\"),")
+	fmt.Fprintln(os.Stderr, "  -history:         specifies where to keep the event history (\"sublogmon.history\" by default, \"\" to disable),")
+	fmt.Fprintln(os.Stderr, "  -history-max-size: maximum size of the event history in megabytes (64 by default),")
+	fmt.Fprintln(os.Stderr, "  -history-max-age: how long to keep events in the history (720h by default),")
+	fmt.Fprintln(os.Stderr, "  -tor-exits:       specifies a list of Tor exit addresses for the network enrichment (\"tor-exits.txt\" by default),")
+	fmt.Fprintln(os.Stderr, "  -blocklist:       specifies a list of known bad addresses and networks for the network enrichment (\"blocklist.txt\" by default),")
+	fmt.Fprintln(os.Stderr, "  -exec-max:        maximum number of Exec actions running at once (4 by default),")
+	fmt.Fprintln(os.Stderr, "  -notify:          show desktop notifications: auto (if the Subgraph event notifier is not installed), always or never,")
+	fmt.Fprintln(os.Stderr, "  -digest-to:       mails a digest of events to these comma separated addresses,")
+	fmt.Fprintln(os.Stderr, "  -digest-interval: how often to mail the digest (24h by default),")
+	fmt.Fprintln(os.Stderr, "  -digest-from:     sender address of the digest (sublogmon@ the host name by default),")
+	fmt.Fprintln(os.Stderr, "  -digest-immediate: also mails every critical event as it happens,")
+	fmt.Fprintln(os.Stderr, "  -smtp:            sends mail through this SMTP relay rather than sendmail,")
+	fmt.Fprintln(os.Stderr, "  -sendmail:        specifies the sendmail binary (\"/usr/sbin/sendmail\" by default),")
 	fmt.Fprintln(os.Stderr, "  -h / -help:       display this help message,")
 }
 
 func main() {
 	progName = os.Args[0]
 
+	if len(os.Args) > 1 && os.Args[1] == "query" {
+		os.Exit(runQuery(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == NOTIFY_HELPER_CMD {
+		os.Exit(runNotifyHelper())
+	}
+
 	var conffile = flag.String("conf", "sublogmon.json", "Specify json config file")
 	var supfile = flag.String("suppress", "suppressions.json", "Specify json config file")
 	flag.StringVar(conffile, "c", "sublogmon.json", "Specify json config file")
 	flag.StringVar(supfile, "s", "suppressions.json", "Specify json config file")
+	var confdir = flag.String("confdir", "sublogmon.d", "Specify directory of drop-in json config files")
+	var dump = flag.Bool("dump-config", false, "Print the merged config and exit")
 	var debug = flag.Bool("debug", false, "Turn on debug mode")
 	flag.BoolVar(debug, "d", false, "Turn on debug mode")
+	var metricsAddr = flag.String("metrics", "", "Serve metrics over HTTP on this localhost address")
+	var statefile = flag.String("state", "sublogmon.state", "Specify file to save read positions in")
+	var shutdownTimeout = flag.Duration("shutdown-timeout", 5*time.Second, "Maximum time to spend shutting down")
+	var heartbeat = flag.Duration("heartbeat", 0, "Interval between D-Bus heartbeat signals (0 to disable)")
+	var useSyslog = flag.Bool("syslog", false, "Also send events to syslog")
+	var useTUI = flag.Bool("tui", false, "Show events on a full-screen dashboard")
+	var colorMode = flag.String("color", "auto", "Use colors: auto, always or never")
+	var sevColors = flag.String("severity-colors", "", "Colors per severity, as severity=color,...")
+	var historyDir = flag.String("history", "sublogmon.history", "Specify directory to keep the event history in")
+	var historyMaxSize = flag.Int64("history-max-size", 64, "Maximum size of the event history in megabytes")
+	var historyMaxAge = flag.Duration("history-max-age", 30*24*time.Hour, "How long to keep events in the history")
+	flag.StringVar(&torExitFile, "tor-exits", "tor-exits.txt", "Specify file listing Tor exit addresses")
+	flag.StringVar(&blocklistFile, "blocklist", "blocklist.txt", "Specify file listing known bad addresses")
+	var execMax = flag.Int("exec-max", 4, "Maximum number of Exec actions running at once")
+	var notifyMode = flag.String("notify", "auto", "Show desktop notifications: auto, always or never")
+	var digestTo = flag.String("digest-to", "", "Mail a digest of events to these comma separated addresses")
+	var digestInterval = flag.Duration("digest-interval", 24*time.Hour, "How often to mail the digest")
+	var digestFrom = flag.String("digest-from", "", "Sender address of the digest")
+	var digestImmediate = flag.Bool("digest-immediate", false, "Also mail every critical event as it happens")
+	var smtpRelay = flag.String("smtp", "", "Send mail through this SMTP relay rather than sendmail")
+	var sendmail = flag.String("sendmail", DEFAULT_SENDMAIL, "Specify the sendmail binary")
 
 	flag.Usage = usage
 	flag.Parse()
@@ -217,175 +335,235 @@ func main() {
 		os.Exit(-1)
 	}
 
-	jfile, err := ioutil.ReadFile(*conffile)
+	if *execMax < 1 {
+		*execMax = 1
+	}
+
+	execSlots = make(chan struct{}, *execMax)
 
-	if err != nil {
-		log.Fatal("Error opening json file: ", err)
-		os.Exit(-1)
+	if *dump {
+
+		if err := dumpConfig(*conffile, *confdir); err != nil {
+			log.Fatal(err)
+		}
+
+		return
+	}
+
+	var err error
+
+	if err = setupColor(*colorMode); err != nil {
+		log.Fatal(err)
 	}
 
-	err = json.Unmarshal(jfile, &AuditLogs)
+	if err = parseSeverityColors(*sevColors); err != nil {
+		log.Fatal(err)
+	}
+
+	AuditLogs, Suppressions, err = loadConfig(*conffile, *confdir, *supfile, *debug)
 
 	if err != nil {
-		log.Fatal("Error decoding json data from config file: ", err)
-		os.Exit(-1)
+		log.Fatal(err)
 	}
 
-	jfile, err = ioutil.ReadFile(*supfile)
+	/*		fmt.Println("Attempting test...")
+			testRegexp(2, 1, "Mar  8 22:09:55 subgraph oz-daemon[23280]: 2017/03/08 22:09:55 [spotify] (stderr) E [FATAL] Seccomp filter compile failed: /var/lib/oz/cells.d/spotify-whitelist.seccomp:18: unexpected end of line")
+			fmt.Println("Exiting.")
+			os.Exit(0) */
 
+	dbo, err := newDbusObject()
 	if err != nil {
-		fmt.Println("Warning: no suppressions file was found!")
-	} else {
+		log.Fatal("Error connecting to SystemBus: ", err)
+	}
 
-		err = json.Unmarshal(jfile, &Suppressions)
+	// Events always go to the event notifier, which may be started later;
+	// failed deliveries are counted in the metrics. Only the desktop
+	// notification fallback depends on whether it is there now.
+	addSink(dbo)
 
-		if err != nil {
-			log.Fatal("Error decoding json data from suppressions file: ", err)
-			os.Exit(-1)
-		}
+	switch *notifyMode {
+	case "always":
+		addSink(newDesktopNotifier())
+	case "auto":
 
-		if *debug {
-			fmt.Fprintf(os.Stderr, "Read a total of %d suppressions from config\n", len(Suppressions))
+		if !nameAvailable(EVENT_NOTIFIER_NAME) {
+			fmt.Println("The Subgraph event notifier is not installed; showing desktop notifications instead.")
+			addSink(newDesktopNotifier())
 		}
 
+	case "never":
+	default:
+		log.Fatal("Bad -notify mode: ", *notifyMode)
 	}
 
-	if *debug {
-		fmt.Fprintf(os.Stderr, "There are %d log file entries\n", len(AuditLogs))
-	}
-
-	for i := 0; i < len(AuditLogs); i++ {
+	if len(*digestTo) > 0 {
 
-		if *debug {
-			fmt.Fprintf(os.Stderr, "{%d} Description = |%s|, Pathname = |%s| -> %d filters\n", i, AuditLogs[i].Description, AuditLogs[i].PathName, len(AuditLogs[i].Filters))
+		if *digestInterval <= 0 {
+			log.Fatal("Bad -digest-interval: ", *digestInterval)
 		}
 
-		for j := 0; j < len(AuditLogs[i].Filters); j++ {
-			fil := &(AuditLogs[i].Filters[j])
-			outStr := "*" + fil.OutputAttr + "*"
-			attr, ok := colorsMap[fil.OutputAttr]
+		if len(*digestFrom) == 0 {
+			hostname, _ := os.Hostname()
+			*digestFrom = "sublogmon@" + hostname
+		}
 
-			if ok {
-				fil.OutputAttr = attr
-			} else {
-				outStr = attr
-			}
+		mail := &mailer{from: *digestFrom, to: strings.Split(*digestTo, ","), relay: *smtpRelay, sendmail: *sendmail}
+		addSink(newDigestSink(mail, *digestInterval, *digestImmediate))
+	}
 
-			if *debug {
-				fmt.Fprintf(os.Stderr, "   [%d] Regexp = %s\n", j+1, fil.Regexp)
-				fmt.Fprintf(os.Stderr, "   [%d] nfields = %d : %v\n", j+1, len(fil.Fields), fil.Fields)
-				fmt.Fprintf(os.Stderr, "   [%d] OutputStr = %s, OutputAttr = %s\n", j+1, fil.OutputStr, outStr)
-			}
+	if len(*historyDir) > 0 {
+		hs, err := newHistoryStore(*historyDir, *historyMaxSize*1024*1024, *historyMaxAge)
 
+		if err != nil {
+			log.Fatal("Could not open the event history: ", err)
 		}
+
+		addSink(hs)
 	}
 
-/*		fmt.Println("Attempting test...")
-		testRegexp(2, 1, "Mar  8 22:09:55 subgraph oz-daemon[23280]: 2017/03/08 22:09:55 [spotify] (stderr) E [FATAL] Seccomp filter compile failed: /var/lib/oz/cells.d/spotify-whitelist.seccomp:18: unexpected end of line")
-		fmt.Println("Exiting.")
-		os.Exit(0) */
+	if *useSyslog {
+		sls, err := newSyslogSink()
 
+		if err != nil {
+			log.Fatal("Error connecting to syslog: ", err)
+		}
 
-	dbo, err := newDbusObject()
-	if err != nil {
-		log.Fatal("Error connecting to SystemBus: %v", err)
+		addSink(sls)
 	}
 
 	if os.Getuid() > 0 {
 		fmt.Println("Warning: this program probably won't run unless you execute it as root.")
 	}
 
-	parentDirs := make(map[string]bool)
+	watcher, err := inotify.NewWatcher()
 
-	for i := 0; i < len(AuditLogs); i++ {
-		f, err := os.OpenFile(AuditLogs[i].PathName, os.O_RDONLY, 0666)
+	if err != nil {
+		log.Fatal("Could not set up new watcher: ", err)
+	}
 
-		if err != nil {
-			log.Fatal("Error opening log file for ", AuditLogs[i].Description, ": ", err)
-		}
+	defer watcher.Close()
 
-		fi, err := f.Stat()
+	if *useTUI {
+		dash, err = newDashboard(*supfile)
 
 		if err != nil {
-			log.Fatal("Could not call stat on log file: ", err)
+			log.Fatal("Could not start the dashboard: ", err)
 		}
 
-		pdir := filepath.Dir(AuditLogs[i].PathName)
+		dash.setFilters(AuditLogs)
+		addSink(dash)
+	}
 
-		if _, ok := parentDirs[pdir]; ok {
-		} else {
-			parentDirs[pdir] = true
-		}
+	for i := 0; i < len(AuditLogs); i++ {
+		startSource(watcher, &AuditLogs[i], true, *debug)
+	}
 
-		// fmt.Printf("total log file size for %s  is %d\n", AuditLogs[i].PathName, fi.Size())
+	dbuf := make([]byte, BUFSIZE)
 
-		ret, err := f.Seek(0, os.SEEK_END)
+	if len(*statefile) > 0 {
 
-		if err != nil {
-			log.Fatal("Unexpected problem occurred while attempting to skip to end of log file: ", err)
-		}
+		// Catch up on whatever was written while we were not running.
+		for _, tail := range restoreState(*statefile, *debug) {
+			src, _ := findTail(tail.PathName)
 
-		if ret != fi.Size() {
-			log.Fatal("Unexpected problem occurred when attempting to skip to end of log file")
-		}
+			for {
+				nread, err := readTail(src, tail, dbuf)
 
-		AuditLogs[i].f = f
+				if err != nil {
+					failTail(watcher, src, tail, err)
+					break
+				}
+
+				if nread == 0 {
+					break
+				}
+
+			}
 
-		for j := 0; j < len(AuditLogs[i].Filters); j++ {
-			AuditLogs[i].Filters[j].Regcomp = regexp.MustCompile(AuditLogs[i].Filters[j].Regexp)
 		}
 
 	}
 
-	watcher, err := inotify.NewWatcher()
+	parentDirs := make(map[string]bool)
+	watchDirs(watcher, parentDirs, AuditLogs, *debug)
+
+	confPath, _ := filepath.Abs(*conffile)
+	supPath, _ := filepath.Abs(*supfile)
+	confWatcher, err := watchConfigFiles(confPath, supPath)
 
 	if err != nil {
-		log.Fatal("Could not set up new watcher: ", err)
+		log.Fatal("Could not set up watcher on config files: ", err)
 	}
 
-	defer watcher.Close()
+	defer confWatcher.Close()
 
-	for i := 0; i < len(AuditLogs); i++ {
+	// Drop-ins may also be removed, which the main config files may not.
+	confdirPath, _ := filepath.Abs(*confdir)
 
-		if *debug {
-			fmt.Println("Adding inotify watcher for service:", AuditLogs[i].Description)
-		}
-		//	err = watcher.AddWatch(AuditLogs[i].PathName, inotify.IN_MODIFY)
-		err = watcher.AddWatch(AuditLogs[i].PathName, inotify.IN_ALL_EVENTS)
-//		err = watcher.Add(AuditLogs[i].PathName)
+	if fi, err := os.Stat(confdirPath); err == nil && fi.IsDir() {
+		err = confWatcher.AddWatch(confdirPath, inotify.IN_CLOSE_WRITE|inotify.IN_MOVED_TO|inotify.IN_DELETE|inotify.IN_MOVED_FROM)
 
 		if err != nil {
-			log.Fatal("Could not set up watcher on log file: ", err)
+			log.Fatal("Could not set up watcher on config directory: ", err)
 		}
 
 	}
 
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
 
-	for dname, _ := range parentDirs {
+	sigterm := make(chan os.Signal, 1)
+	signal.Notify(sigterm, syscall.SIGINT, syscall.SIGTERM)
 
-		if *debug {
-			fmt.Println("Adding inotify watcher for parent directory events:", dname)
+	if dash != nil {
+		dash.Lock()
+		dash.quit = sigterm
+		dash.Unlock()
+	}
+
+	reload := func(why string) {
+		fmt.Printf("Reloading configuration (%s)...\n", why)
+		err := reloadConfig(watcher, parentDirs, *conffile, *confdir, *supfile, *debug)
+
+		if err != nil {
+			fmt.Println("Error reloading configuration; keeping the old one: ", err)
+			return
 		}
 
-//		err = watcher.Add(dname)
-		err = watcher.AddWatch(dname, inotify.IN_ALL_EVENTS|inotify.IN_ISDIR)
+		if dash != nil {
+			dash.setFilters(AuditLogs)
+		}
+
+		fmt.Printf("Configuration reloaded: monitoring %d log files.\n", len(AuditLogs))
+	}
+
+	if len(*metricsAddr) > 0 {
+		err = serveMetrics(*metricsAddr)
 
 		if err != nil {
-			log.Fatal("Could not set up watcher on log file directory: ", err)
+			log.Fatal("Could not start metrics listener: ", err)
 		}
 
 	}
 
-	fmt.Printf("Done loading, going into I/O loop.\n")
+	retryTicker := time.NewTicker(MIN_RETRY_DELAY)
+	defer retryTicker.Stop()
 
-	dbuf := make([]byte, BUFSIZE)
-	last_buf := ""
-	last_repeat := 0
+	var heartbeatC <-chan time.Time
+
+	if *heartbeat > 0 {
+		heartbeatTicker := time.NewTicker(*heartbeat)
+		defer heartbeatTicker.Stop()
+		heartbeatC = heartbeatTicker.C
+		sendHeartbeat(*heartbeat)
+	}
+
+	fmt.Printf("Done loading, going into I/O loop.\n")
 
 	for {
 
 		select {
-//		case ev := <-watcher.Events:
+		//		case ev := <-watcher.Events:
 		case ev := <-watcher.Event:
 			// fmt.Println("watcher event")
 			// log.Println("event: ", ev)
@@ -396,8 +574,6 @@ func main() {
 			switch ev.Mask {
 			case inotify.IN_ACCESS:
 				fallthrough
-			case inotify.IN_ATTRIB:
-				fallthrough
 			case inotify.IN_CLOSE:
 				fallthrough
 			case inotify.IN_CLOSE_WRITE:
@@ -411,68 +587,129 @@ func main() {
 				continue
 			}
 
-			if ev.Mask & (inotify.IN_MODIFY | inotify.IN_CREATE | inotify.IN_DELETE | inotify.IN_DELETE_SELF | inotify.IN_MOVE_SELF | inotify.IN_ISDIR | inotify.IN_OPEN | inotify.IN_MOVED_TO | inotify.IN_MOVED_FROM) == 0 {
+			if ev.Mask&(inotify.IN_MODIFY|inotify.IN_ATTRIB|inotify.IN_CREATE|inotify.IN_DELETE|inotify.IN_DELETE_SELF|inotify.IN_MOVE_SELF|inotify.IN_ISDIR|inotify.IN_OPEN|inotify.IN_MOVED_TO|inotify.IN_MOVED_FROM) == 0 {
 				fmt.Printf("Received unexpected notification event type (%x)... ignoring.\n", ev.Mask)
 				continue
 			}
 
 			// fmt.Println("caught event operation: ", ev.Op, " / hmm: ", ev.Name)
 
-			i := 0
+			src, tail := findTail(ev.Name)
 
-			for i < len(AuditLogs) {
+			if tail == nil {
+				idir := filepath.Dir(ev.Name)
 
-				if AuditLogs[i].PathName == ev.Name {
-					// fmt.Printf("comparison: |%s| vs |%s|\n", ev.Name, AuditLogs[i].PathName)
-					break
+				_, ok := parentDirs[idir]
+
+				if !ok {
+
+					// Most likely a late event for a file that was just dropped by a reload.
+					if *debug {
+						fmt.Println("Ignoring inotify event for unknown filename: ", ev.Name)
+					}
+
+					continue
 				}
 
-				i++
-			}
+				if ev.Mask&inotify.IN_MOVED_TO != 0 {
+					checkMovedTo(ev.Name, ev.Cookie)
+				}
 
-			if i == len(AuditLogs) {
-				idir := filepath.Dir(ev.Name)
+				if ev.Mask&(inotify.IN_CREATE|inotify.IN_MOVED_TO) == 0 {
+					continue
+				}
 
-				_, ok := parentDirs[idir]
+				if src = findSourceFor(ev.Name); src == nil {
+					continue
+				}
 
-				if !ok {
-					log.Fatal("Unexpected error occurred: received inotify event for unknown filename \"", ev.Name, "\"")
+				if *debug {
+					fmt.Println("New file matching", src.PathName, "appeared: ", ev.Name)
 				}
 
+				err = addTail(watcher, src, ev.Name, false)
+
+				if err != nil {
+					setSourceStatus(src, SOURCE_ERRORED, err)
+					continue
+				}
+
+				setSourceStatus(src, SOURCE_ACTIVE, nil)
+				tail = src.tails[ev.Name]
+			}
+
+			if ev.Mask&inotify.IN_ATTRIB != 0 {
+				checkAttrib(src, tail)
 				continue
 			}
 
+			if ev.Mask&(inotify.IN_DELETE|inotify.IN_DELETE_SELF) != 0 {
+				checkDeleted(src, tail)
+			}
+
+			if ev.Mask&inotify.IN_MOVED_FROM != 0 {
+				noteMovedFrom(tail, ev.Cookie)
+			}
+
+			// Files matched by a glob come and go; stop following any that are gone for good.
+
+			if isGlobPattern(src.PathName) && ev.Mask&(inotify.IN_DELETE|inotify.IN_DELETE_SELF|inotify.IN_MOVED_FROM|inotify.IN_MOVE_SELF) != 0 {
+
+				if _, err := os.Stat(ev.Name); err != nil {
+
+					if *debug {
+						fmt.Println("No longer following removed log file: ", ev.Name)
+					}
+
+					removeTail(watcher, src, ev.Name)
+					continue
+				}
+
+			}
+
 			// XXX: At the moment it seems the only event not handled properly if is a log file is opened with O_TRUNC.
 			// There does not seem to be any clean way to detect this; therefore the initial write to such a file will be missed by the monitor.
 
-			if ev.Mask & inotify.IN_CREATE == inotify.IN_CREATE {
+			if ev.Mask&inotify.IN_CREATE == inotify.IN_CREATE {
 
 				if *debug {
 					fmt.Println("Looks like a monitored file just rolled over: ", ev.Name)
 				}
 
-				AuditLogs[i].f.Close()
+				metrics.countRotation(src)
+				src.rotatedAt = time.Now()
 
-				AuditLogs[i].f, err = os.OpenFile(AuditLogs[i].PathName, os.O_RDONLY, 0666)
+				tail.f.Close()
+
+				tail.f, err = os.OpenFile(tail.PathName, os.O_RDONLY, 0666)
 
 				if err != nil {
-					log.Fatal("Error re-opening rolled log file ", AuditLogs[i].PathName, ": ", err)
+					failTail(watcher, src, tail, err)
+					continue
 				}
 
-			} else if ev.Mask & (inotify.IN_MOVED_TO|inotify.IN_MOVED_FROM) != 0 {
+				checkReplaced(src, tail)
+
+			} else if ev.Mask&(inotify.IN_MOVED_TO|inotify.IN_MOVED_FROM) != 0 {
 				if *debug {
 					fmt.Println("Looks like a monitored file just rolled over (rename): ", ev.Name)
 				}
 
-				AuditLogs[i].f.Close()
+				metrics.countRotation(src)
+				src.rotatedAt = time.Now()
+
+				tail.f.Close()
 
-				AuditLogs[i].f, err = os.OpenFile(AuditLogs[i].PathName, os.O_RDONLY, 0666)
+				tail.f, err = os.OpenFile(tail.PathName, os.O_RDONLY, 0666)
 
 				if err != nil {
-					log.Fatal("Error re-opening rolled log file ", AuditLogs[i].PathName, ": ", err)
+					failTail(watcher, src, tail, err)
+					continue
 				}
 
-				_, err := AuditLogs[i].f.Seek(0, os.SEEK_END)
+				checkReplaced(src, tail)
+
+				_, err := tail.f.Seek(0, os.SEEK_END)
 
 				if err != nil {
 					fmt.Println("Seek failed in rolled logfile: ", err)
@@ -480,111 +717,56 @@ func main() {
 
 			}
 
-			if ev.Mask & inotify.IN_MODIFY != inotify.IN_MODIFY {
+			if ev.Mask&inotify.IN_MODIFY != inotify.IN_MODIFY {
 				continue
 			}
 
-			os.Getuid()
-			nread, err := AuditLogs[i].f.Read(dbuf)
-			os.Getpid()
+			checkShrink(src, tail)
+			_, err = readTail(src, tail, dbuf)
 
-			if err != nil && nread != 0 {
-				log.Fatal("Error reading new data from log file: ", err)
+			if err != nil {
+				failTail(watcher, src, tail, err)
 			}
 
-			if nread == 0 {
-				// fmt.Printf("Reached EOF for %s; attempting to ignore.\n", AuditLogs[i].PathName)
-				_, err := AuditLogs[i].f.Seek(0, os.SEEK_END)
+		case err := <-watcher.Error:
+			log.Println("error: ", err)
 
-				if err != nil {
-					fmt.Println("Seek failed: ", err)
-				}
+		case now := <-retryTicker.C:
+			retrySources(watcher, parentDirs, *debug)
+			checkSilence(now)
+			expirePendingMoves(now)
 
-				continue
-			}
+		case <-heartbeatC:
+			sendHeartbeat(*heartbeat)
 
-			//fmt.Printf("ended up reading %d bytes from log\n", nread)
+		case res := <-execResults:
+			reportExec(res)
 
-			sbuf := string(dbuf[:nread])
-			AuditLogs[i].Backlog += sbuf
+		case <-sighup:
+			reload("SIGHUP")
 
-			nIndex := strings.Index(AuditLogs[i].Backlog, "\n")
+		case sig := <-sigterm:
+			watcher.Close()
+			confWatcher.Close()
 
-			if nIndex == -1 {
-				continue
+			if dash != nil {
+				dash.close()
 			}
 
-			for nIndex != -1 {
-				curLine := AuditLogs[i].Backlog[0:nIndex]
-				//fmt.Printf("current line = |%s|\n", curLine)
-				AuditLogs[i].Backlog = AuditLogs[i].Backlog[nIndex+1:]
-				nIndex = strings.Index(AuditLogs[i].Backlog, "\n")
-
-				for j := 0; j < len(AuditLogs[i].Filters); j++ {
-					// fmt.Printf("trying regex filter %d: %s\n", j, AuditLogs[i].Filters[j].Regexp)
-					// fmt.Printf("AGAINST: %s\n", curLine)
-
-					match := AuditLogs[i].Filters[j].Regcomp.FindStringSubmatch(curLine)
+			shutdown(sig, *statefile, *shutdownTimeout)
+			return
 
-					if match == nil {
-						//							fmt.Printf("%sdid not match, continuing%s\n", ANSI_COLOR_RED_BOLD, ANSI_COLOR_RESET)
-						continue
-					}
-
-					rmap := make(map[string]string)
-
-					for k, name := range AuditLogs[i].Filters[j].Regcomp.SubexpNames() {
-
-						if k != 0 {
-							rmap[name] = match[k]
-						}
-
-					}
-
-					/* for k := 0; k < len(AuditLogs[i].Filters[j].Fields); k++ {
-						fstr := AuditLogs[i].Filters[j].Fields[k]
-						fmt.Printf("Extracting field: %s = %s\n", fstr, rmap[fstr])
-					} */
-
-					outstr := formatOutput(AuditLogs[i].Filters[j].OutputStr, rmap)
-
-					if len(outstr) == 0 {
-						fmt.Println("*** Filter condition was matched but no output string was generated")
-					} else {
-						alertstr := outstr
-						if len(AuditLogs[i].Filters[j].OutputAttr) > 0 {
-							outstr = AuditLogs[i].Filters[j].OutputAttr + outstr + colorsMap["ANSI_COLOR_RESET"]
-						}
-
-						now := time.Now().UnixNano()
-
-						if last_buf == outstr {
-							last_repeat++
-							fmt.Print("\r", colorsMap["ANSI_COLOR_GREEN"], "--- Suppressed identical output line ", last_repeat, " times.", colorsMap["ANSI_COLOR_RESET"])
-							dbo.alertObj(AuditLogs[i].Filters[j].ID, AuditLogs[i].Filters[j].Severity, now, alertstr, curLine, rmap)
-							break
-						} else {
-
-							if last_repeat > 0 {
-								fmt.Println("")
-							}
-
-							last_buf = outstr
-							last_repeat = 0
-
-						}
-
-						fmt.Println("* ", outstr)
-						dbo.alertObj(AuditLogs[i].Filters[j].ID, AuditLogs[i].Filters[j].Severity, now, alertstr, curLine, rmap)
-						break
-					}
-
-				}
+		case ev := <-confWatcher.Event:
+			ename := filepath.Clean(ev.Name)
 
+			if ename == confPath || ename == supPath {
+				reload("modified " + ename)
+			} else if filepath.Dir(ename) == confdirPath && isConfigFile(ename) {
+				reload("changed " + ename)
 			}
 
-		case err := <-watcher.Error:
-			log.Println("error: ", err)
+		case err := <-confWatcher.Error:
+			log.Println("config watcher error: ", err)
 		}
 
 	}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// lastOutput and lastRepeat collapse runs of identical console lines into a
+// single line with a repeat counter.
+var lastOutput string
+var lastRepeat int
+
+// matchFilter runs a single filter against the body of a log line. It
+// returns the named captures of the filter's regexp and the fields found by
+// its parser, along with the fields of the line's header, or nil if the line
+// did not match or fails one of the filter's Match predicates.
+func matchFilter(fil *LogFilter, line string, header map[string]string) map[string]string {
+	rmap := make(map[string]string)
+
+	if fil.Regcomp != nil {
+		match := fil.Regcomp.FindStringSubmatch(line)
+
+		if match == nil {
+			return nil
+		}
+
+		for k, name := range fil.Regcomp.SubexpNames() {
+
+			if k != 0 {
+				rmap[name] = match[k]
+			}
+
+		}
+
+	}
+
+	if fil.parse != nil {
+		fields := fil.parse(line)
+
+		if fields == nil {
+			return nil
+		}
+
+		// Named captures win over parsed fields of the same name.
+		for key, val := range fields {
+
+			if _, ok := rmap[key]; !ok {
+				rmap[key] = val
+			}
+
+		}
+
+	}
+
+	for key, val := range header {
+
+		if _, ok := rmap[key]; !ok {
+			rmap[key] = val
+		}
+
+	}
+
+	for key, re := range fil.matchRegcomp {
+		val, ok := rmap[key]
+
+		if !ok || !re.MatchString(val) {
+			return nil
+		}
+
+	}
+
+	return rmap
+}
+
+// suppressedBy returns the suppression, if any, that an event falls under.
+// A suppression applies when its wildcard matches somewhere in the output
+// string and each of its metadata patterns matches somewhere in the value of
+// the metadata key of the same name, which may be a capture, a header field
+// or a key added by enrichment. A suppression with neither never applies.
+func suppressedBy(outstr string, rmap map[string]string) *LogSuppression {
+
+	for i := 0; i < len(Suppressions); i++ {
+		sup := &Suppressions[i]
+
+		if sup.Regcomp == nil && len(sup.MetaRegcomp) == 0 {
+			continue
+		}
+
+		if sup.Regcomp != nil && !sup.Regcomp.MatchString(outstr) {
+			continue
+		}
+
+		matched := true
+
+		for key, re := range sup.MetaRegcomp {
+			val, ok := rmap[key]
+
+			if !ok || !re.MatchString(val) {
+				matched = false
+				break
+			}
+
+		}
+
+		if matched {
+			return sup
+		}
+
+	}
+
+	return nil
+}
+
+// processLine runs one complete log line through a source's filters, in the
+// order in which they appear in the config. Every filter that matches and
+// produces output raises an event, unless a suppression applies to it.
+// Matching is final by default: once a filter has matched, later filters are
+// only tried if it has "Continue" set.
+//
+// Lines are first run through the source's prefilter so that filters whose
+// required literal does not occur in the line are never run. Filters are then
+// run against the body of the line, after the header of the source's Format.
+func processLine(src *LogAuditFile, tail *logTail, line string) {
+	observed := time.Now()
+	tryFilter, any := prefilterLine(src, line)
+
+	if !any {
+		return
+	}
+
+	hdr := parseHeader(src, line)
+
+	for j := 0; j < len(src.Filters); j++ {
+
+		if !tryFilter(j) {
+			continue
+		}
+
+		fil := &src.Filters[j]
+		rmap := matchFilter(fil, hdr.Body, hdr.Fields)
+
+		if rmap == nil {
+			continue
+		}
+
+		if _, ok := rmap["logfile"]; !ok {
+			rmap["logfile"] = tail.PathName
+		}
+
+		if len(fil.Tags) > 0 {
+			rmap["tags"] = strings.Join(fil.Tags, ",")
+		}
+
+		// Enrichment comes first so that typing and conditions can use what
+		// it adds.
+		enrichEvent(fil, rmap)
+		typed := typeFields(fil, rmap)
+
+		if !conditionsHold(fil, rmap, typed) {
+			continue
+		}
+
+		outstr := formatTyped(fil.OutputStr, rmap, typed)
+
+		if len(outstr) == 0 {
+			fmt.Println("*** Filter condition was matched but no output string was generated")
+			continue
+		}
+
+		metrics.countMatch(fil)
+
+		if sup := suppressedBy(outstr, rmap); sup != nil {
+			metrics.countSuppressed(sup)
+		} else {
+			emitEvent(src, fil, outstr, line, hdr, observed, rmap, typed)
+
+			if fil.Exec != nil {
+				runExec(src, fil, rmap, typed)
+			}
+
+		}
+
+		if !fil.Continue {
+			break
+		}
+
+	}
+
+}
+
+// renderOutput formats one of a filter's per-sink templates, falling back to
+// the already formatted OutputStr if the template is not set or fails.
+func renderOutput(tmpl, fallback string, rmap map[string]string, typed map[string]interface{}) string {
+
+	if len(tmpl) == 0 {
+		return fallback
+	}
+
+	if out := formatTyped(tmpl, rmap, typed); len(out) > 0 {
+		return out
+	}
+
+	return fallback
+}
+
+// emitEvent prints an event to the console and hands it to the output sinks.
+// The event is given the time the line was logged, if its header has one,
+// and otherwise the time it was read.
+func emitEvent(src *LogAuditFile, fil *LogFilter, alertstr, line string, hdr *lineHeader, observed time.Time, rmap map[string]string, typed map[string]interface{}) {
+	when := hdr.Time
+
+	if when.IsZero() {
+		when = observed
+	}
+
+	ev := &logEvent{
+		Source:  sourceLabel(src),
+		Output:  alertstr,
+		Title:   renderOutput(fil.OutputTitle, alertstr, rmap, typed),
+		Console: renderOutput(fil.OutputConsole, alertstr, rmap, typed),
+		Syslog:  renderOutput(fil.OutputSyslog, alertstr, rmap, typed),
+		Typed:   typed,
+	}
+	ev.slmData = slmData{fil.ID, fil.Severity, when.UnixNano(), renderOutput(fil.OutputBody, alertstr, rmap, typed), line, rmap, observed.UnixNano()}
+	outstr := ev.Console
+
+	// The dashboard shows events itself.
+	if dash != nil {
+		deliverEvent(ev)
+		return
+	}
+
+	outstr = colorize(eventColor(fil), outstr)
+
+	if lastOutput == outstr {
+		lastRepeat++
+
+		if interactive {
+			fmt.Print("\r", colorize(colorsMap["ANSI_COLOR_GREEN"], fmt.Sprintf("--- Suppressed identical output line %d times.", lastRepeat)))
+		}
+
+	} else {
+		flushRepeats()
+		lastOutput = outstr
+		fmt.Println("* ", outstr)
+	}
+
+	deliverEvent(ev)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordSink keeps every event delivered to it.
+type recordSink struct {
+	events []*logEvent
+}
+
+func (rs *recordSink) Name() string {
+	return "test recorder"
+}
+
+func (rs *recordSink) Send(ev *logEvent) error {
+	rs.events = append(rs.events, ev)
+	return nil
+}
+
+// loadTestConfig loads a source config given as JSON, without drop-ins or
+// suppressions.
+func loadTestConfig(t testing.TB, conf string) []LogAuditFile {
+	fname := filepath.Join(t.TempDir(), "sublogmon.json")
+
+	if err := ioutil.WriteFile(fname, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	logs, _, err := loadConfig(fname, "", "", false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return logs
+}
+
+// loadTestSuppressions loads a source config and a suppression file, both
+// given as JSON, and puts the suppressions in effect for the rest of the test.
+func loadTestSuppressions(t testing.TB, conf, sups string) []LogAuditFile {
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "sublogmon.json")
+	supname := filepath.Join(dir, "suppressions.json")
+
+	if err := ioutil.WriteFile(fname, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(supname, []byte(sups), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	logs, loaded, err := loadConfig(fname, "", supname, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Suppressions = loaded
+	t.Cleanup(func() { Suppressions = nil })
+	return logs
+}
+
+// findSource returns the source with the given SourceName.
+func findSource(t testing.TB, logs []LogAuditFile, name string) *LogAuditFile {
+
+	for i := 0; i < len(logs); i++ {
+
+		if logs[i].SourceName == name {
+			return &logs[i]
+		}
+
+	}
+
+	t.Fatalf("no source named %s", name)
+	return nil
+}
+
+// runLines runs lines through a source and returns the events they raised.
+func runLines(src *LogAuditFile, lines ...string) []*logEvent {
+	rs := &recordSink{}
+	sinks = []*sinkQueue{newSinkQueue(rs)}
+	tail := &logTail{PathName: src.PathName}
+
+	for _, line := range lines {
+		processLine(src, tail, line)
+	}
+
+	flushSinks(time.Now().Add(5 * time.Second))
+	return rs.events
+}
+
+func eventIDs(events []*logEvent) []string {
+	var ids []string
+
+	for _, ev := range events {
+		ids = append(ids, ev.EventID)
+	}
+
+	return ids
+}
+
+const continueConfig = `[
+{ "Description": "test", "SourceName": "test", "PathName": "/tmp/test.log",
+  "Filters": [
+    { "ID": "first",  "Regexp": "denied (?P<what>\\w+)", "OutputStr": "first {what}",  "Severity": "alert", "Tags": ["access", "denial"] %s },
+    { "ID": "second", "Regexp": "denied",                "OutputStr": "second",        "Severity": "info" },
+    { "ID": "third",  "Regexp": "allowed",               "OutputStr": "third",         "Severity": "info" }
+  ]
+}]`
+
+func TestProcessLineFirstMatchStops(t *testing.T) {
+	logs := loadTestConfig(t, fmt.Sprintf(continueConfig, ""))
+	events := runLines(&logs[0], "access denied open", "access allowed", "nothing to see")
+
+	if ids := eventIDs(events); !reflect.DeepEqual(ids, []string{"first", "third"}) {
+		t.Fatalf("got events %v, want [first third]", ids)
+	}
+
+	if events[0].Output != "first open" {
+		t.Errorf("got output %q, want \"first open\"", events[0].Output)
+	}
+
+}
+
+func TestProcessLineContinue(t *testing.T) {
+	logs := loadTestConfig(t, fmt.Sprintf(continueConfig, `, "Continue": true`))
+	events := runLines(&logs[0], "access denied open")
+
+	if ids := eventIDs(events); !reflect.DeepEqual(ids, []string{"first", "second"}) {
+		t.Fatalf("got events %v, want [first second]", ids)
+	}
+
+}
+
+func TestProcessLineTags(t *testing.T) {
+	logs := loadTestConfig(t, fmt.Sprintf(continueConfig, `, "Continue": true`))
+	events := runLines(&logs[0], "access denied open")
+
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want 2", len(events))
+	}
+
+	if tags := events[0].Metadata["tags"]; tags != "access,denial" {
+		t.Errorf("got tags %q, want \"access,denial\"", tags)
+	}
+
+	if tags, ok := events[1].Metadata["tags"]; ok {
+		t.Errorf("filter without Tags got tags %q", tags)
+	}
+
+	if logfile := events[0].Metadata["logfile"]; logfile != "/tmp/test.log" {
+		t.Errorf("got logfile %q, want /tmp/test.log", logfile)
+	}
+
+}
+
+// The shipped kernel source lists grsec-denied before the catch-all grsec
+// filter, so that a denial raises a single, specific event.
+func TestShippedGrsecOrdering(t *testing.T) {
+	logs, _, err := loadConfig("sublogmon.json", "", "", false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := findSource(t, logs, "kernel")
+
+	tests := []struct {
+		line string
+		ids  []string
+	}{
+		{"Mar  8 22:09:55 subgraph kernel: [ 5140.900123] grsec: denied resource overstep by requesting 4096 for RLIMIT_CORE against limit 0 for /usr/bin/foo[foo:1234] uid/euid:1000/1000 gid/egid:1000/1000, parent /bin/bash[bash:1000] uid/euid:1000/1000 gid/egid:1000/1000",
+			[]string{"grsec-denied"}},
+		{"Mar  8 22:09:56 subgraph kernel: [ 5141.000001] grsec: From 10.0.0.1: use of CAP_SYS_ADMIN in chroot denied",
+			[]string{"grsec"}},
+		{"Mar  8 22:09:57 subgraph kernel: [ 5141.100001] usb 1-1: new high-speed USB device number 2 using xhci_hcd",
+			nil},
+	}
+
+	for _, test := range tests {
+		events := runLines(src, test.line)
+
+		if ids := eventIDs(events); !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("%s: got events %v, want %v", test.line, ids, test.ids)
+		}
+
+	}
+
+	events := runLines(src, tests[0].line)
+
+	if len(events) != 1 {
+		t.Fatalf("got %d events, want 1", len(events))
+	}
+
+	if meta := events[0].Metadata; meta["action"] != "resource" || meta["process"] != "/usr/bin/foo" {
+		t.Errorf("got action %q and process %q, want resource and /usr/bin/foo", meta["action"], meta["process"])
+	}
+
+}
+
+// Conditions can use header fields and enriched keys, with the types given
+// in Fields, as well as captures.
+func TestConditionsOnEveryField(t *testing.T) {
+	logs := loadTestConfig(t, `[
+{ "Description": "test", "SourceName": "test", "PathName": "/tmp/test.log", "Format": "rfc3164",
+  "Filters": [
+    { "ID": "typed", "Regexp": "start uid=(?P<uid>[0-9]+)", "OutputStr": "{uid}",
+      "Enrich": ["user"], "Fields": ["pid:int"], "Conditions": ["pid > 100", "program == tool", "uid_user == root", "logfile == /tmp/test.log"] }
+  ]
+}]`)
+	events := runLines(&logs[0],
+		"Mar  8 22:09:55 subgraph tool[1234]: start uid=0",
+		"Mar  8 22:09:55 subgraph tool[12]: start uid=0",
+		"Mar  8 22:09:55 subgraph other[1234]: start uid=0")
+
+	if len(events) != 1 || events[0].Metadata["pid"] != "1234" {
+		t.Fatalf("got %d events, want the one from pid 1234", len(events))
+	}
+
+	for _, cond := range []string{"seq > 1", "sandbox == x", "ip_class == public"} {
+		fname := filepath.Join(t.TempDir(), "sublogmon.json")
+		conf := fmt.Sprintf(`[ { "SourceName": "test", "PathName": "/tmp/test.log", "Format": "rfc3164",
+  "Filters": [ { "ID": "x", "Regexp": "x", "OutputStr": "x", "Enrich": ["user"], "Conditions": [%q] } ] } ]`, cond)
+
+		if err := ioutil.WriteFile(fname, []byte(conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err := loadConfig(fname, "", "", false); err == nil {
+			t.Errorf("condition %q on a field nothing provides was accepted", cond)
+		}
+
+	}
+
+}
+
+func TestSuppression(t *testing.T) {
+	logs := loadTestSuppressions(t, fmt.Sprintf(continueConfig, ""), `[
+  { "description": "test: opens", "wildcard": "first open" },
+  { "description": "test: never", "metadata": { "what": "^nothing$" } }
+]`)
+	before := metrics.suppressed["test: opens"]
+	events := runLines(&logs[0], "access denied open", "access denied write")
+
+	if ids := eventIDs(events); !reflect.DeepEqual(ids, []string{"first"}) || events[0].Output != "first write" {
+		t.Fatalf("got events %v, want only first for the write", ids)
+	}
+
+	if n := metrics.suppressed["test: opens"] - before; n != 1 {
+		t.Errorf("suppression counted %d times, want 1", n)
+	}
+
+	var buf bytes.Buffer
+	metrics.writeTo(&buf)
+
+	if !strings.Contains(buf.String(), `sublogmon_suppressed_total{suppression="test: opens"}`) {
+		t.Errorf("no suppressed_total series in the metrics:\n%s", buf.String())
+	}
+
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the line processing
+// latency histogram.
+var latencyBuckets = []float64{0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+
+	for i, le := range latencyBuckets {
+
+		if v <= le {
+			h.counts[i]++
+		}
+
+	}
+
+	h.sum += v
+	h.count++
+}
+
+// monMetrics holds everything exported on the metrics endpoint. It is updated
+// from the main loop and read by the HTTP server, hence the lock.
+type monMetrics struct {
+	sync.Mutex
+	linesRead    map[string]uint64
+	bytesRead    map[string]uint64
+	matches      map[string]uint64
+	suppressed   map[string]uint64
+	rotations    map[string]uint64
+	backlog      map[string]uint64
+	latency      map[string]*histogram
+	status       map[string]string
+	dbusFailures uint64
+}
+
+var metrics = monMetrics{
+	linesRead:  make(map[string]uint64),
+	bytesRead:  make(map[string]uint64),
+	matches:    make(map[string]uint64),
+	suppressed: make(map[string]uint64),
+	rotations:  make(map[string]uint64),
+	backlog:    make(map[string]uint64),
+	latency:    make(map[string]*histogram),
+	status:     make(map[string]string),
+}
+
+// sourceLabel is the name a log source is reported under.
+func sourceLabel(src *LogAuditFile) string {
+
+	if len(src.SourceName) > 0 {
+		return src.SourceName
+	}
+
+	return src.PathName
+}
+
+func (m *monMetrics) countRead(src *LogAuditFile, nbytes int) {
+	m.Lock()
+	m.bytesRead[sourceLabel(src)] += uint64(nbytes)
+	m.Unlock()
+}
+
+// countLine records a processed line and how long it took to process.
+func (m *monMetrics) countLine(src *LogAuditFile, took time.Duration) {
+	label := sourceLabel(src)
+	m.Lock()
+	m.linesRead[label]++
+	h, ok := m.latency[label]
+
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.latency[label] = h
+	}
+
+	h.observe(took.Seconds())
+	m.Unlock()
+}
+
+func (m *monMetrics) countMatch(fil *LogFilter) {
+	m.Lock()
+	m.matches[fil.ID]++
+	m.Unlock()
+}
+
+func (m *monMetrics) countSuppressed(sup *LogSuppression) {
+	m.Lock()
+	m.suppressed[sup.Description]++
+	m.Unlock()
+}
+
+func (m *monMetrics) countRotation(src *LogAuditFile) {
+	m.Lock()
+	m.rotations[sourceLabel(src)]++
+	m.Unlock()
+}
+
+func (m *monMetrics) countDbusFailure() {
+	m.Lock()
+	m.dbusFailures++
+	m.Unlock()
+}
+
+// setBacklog records how much unterminated data a source is holding on to.
+func (m *monMetrics) setBacklog(src *LogAuditFile) {
+	size := 0
+
+	for _, tail := range src.tails {
+		size += len(tail.Backlog)
+	}
+
+	m.Lock()
+	m.backlog[sourceLabel(src)] = uint64(size)
+	m.Unlock()
+}
+
+func (m *monMetrics) setStatus(src *LogAuditFile) {
+	m.Lock()
+	m.status[sourceLabel(src)] = src.status
+	m.Unlock()
+}
+
+// dashboardCounts copies out what the -tui dashboard shows of each source and
+// filter.
+func (m *monMetrics) dashboardCounts() (map[string]string, map[string]uint64, map[string]uint64) {
+	status := make(map[string]string)
+	lines := make(map[string]uint64)
+	matches := make(map[string]uint64)
+	m.Lock()
+
+	for label, st := range m.status {
+		status[label] = st
+		lines[label] = m.linesRead[label]
+	}
+
+	for id, n := range m.matches {
+		matches[id] = n
+	}
+
+	m.Unlock()
+	return status, lines, matches
+}
+
+func escapeLabel(val string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(val)
+}
+
+func writeCounterMap(w io.Writer, name, help, label, mtype string, vals map[string]uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, mtype)
+	keys := make([]string, 0, len(vals))
+
+	for key := range vals {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, label, escapeLabel(key), vals[key])
+	}
+
+}
+
+// writeTo renders all metrics in the Prometheus text exposition format. The
+// lock is held throughout, so w should be a buffer rather than a client
+// connection that could hold up the main loop.
+func (m *monMetrics) writeTo(w io.Writer) {
+	m.Lock()
+	defer m.Unlock()
+
+	writeCounterMap(w, "sublogmon_lines_read_total", "Lines read from each log source.", "source", "counter", m.linesRead)
+	writeCounterMap(w, "sublogmon_bytes_read_total", "Bytes read from each log source.", "source", "counter", m.bytesRead)
+	writeCounterMap(w, "sublogmon_filter_matches_total", "Lines matched by each filter.", "filter", "counter", m.matches)
+	writeCounterMap(w, "sublogmon_suppressed_total", "Events dropped by each suppression.", "suppression", "counter", m.suppressed)
+	writeCounterMap(w, "sublogmon_rotations_total", "Log file rotations seen for each log source.", "source", "counter", m.rotations)
+	writeCounterMap(w, "sublogmon_backlog_bytes", "Bytes of incomplete lines held for each log source.", "source", "gauge", m.backlog)
+
+	fmt.Fprintf(w, "# HELP sublogmon_dbus_failures_total Events that could not be delivered over D-Bus.\n")
+	fmt.Fprintf(w, "# TYPE sublogmon_dbus_failures_total counter\n")
+	fmt.Fprintf(w, "sublogmon_dbus_failures_total %d\n", m.dbusFailures)
+
+	fmt.Fprintf(w, "# HELP sublogmon_source_status Current status of each log source.\n")
+	fmt.Fprintf(w, "# TYPE sublogmon_source_status gauge\n")
+	labels := make([]string, 0, len(m.status))
+
+	for label := range m.status {
+		labels = append(labels, label)
+	}
+
+	sort.Strings(labels)
+
+	for _, label := range labels {
+
+		for _, status := range []string{SOURCE_ACTIVE, SOURCE_WAITING, SOURCE_ERRORED} {
+			val := 0
+
+			if m.status[label] == status {
+				val = 1
+			}
+
+			fmt.Fprintf(w, "sublogmon_source_status{source=\"%s\",status=\"%s\"} %d\n", escapeLabel(label), status, val)
+		}
+
+	}
+
+	name := "sublogmon_line_processing_seconds"
+	fmt.Fprintf(w, "# HELP %s Time taken to run a line through its source's filters.\n# TYPE %s histogram\n", name, name)
+	keys := make([]string, 0, len(m.latency))
+
+	for key := range m.latency {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		h := m.latency[key]
+		label := escapeLabel(key)
+
+		for i, le := range latencyBuckets {
+			fmt.Fprintf(w, "%s_bucket{source=\"%s\",le=\"%g\"} %d\n", name, label, le, h.counts[i])
+		}
+
+		fmt.Fprintf(w, "%s_bucket{source=\"%s\",le=\"+Inf\"} %d\n", name, label, h.count)
+		fmt.Fprintf(w, "%s_sum{source=\"%s\"} %g\n", name, label, h.sum)
+		fmt.Fprintf(w, "%s_count{source=\"%s\"} %d\n", name, label, h.count)
+	}
+
+}
+
+// serveMetrics starts the metrics HTTP listener. Only loopback addresses are
+// accepted, since the counters reveal what is going on in the system logs.
+func serveMetrics(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+
+	if err != nil {
+		return err
+	}
+
+	if host != "localhost" {
+		ip := net.ParseIP(host)
+
+		if ip == nil || !ip.IsLoopback() {
+			return fmt.Errorf("refusing to serve metrics on non-loopback address %s", addr)
+		}
+
+	}
+
+	ln, err := net.Listen("tcp", addr)
+
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		var buf bytes.Buffer
+		metrics.writeTo(&buf)
+		w.Write(buf.Bytes())
+	})
+
+	go http.Serve(ln, mux)
+	return nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const SERVICES_FILE = "/etc/services"
+
+// The captured fields the network enrichment looks at. Values that are not
+// IP addresses, such as a host name in "host", are left alone.
+var ipFields = []string{"ip", "host", "addr", "saddr", "daddr", "src", "dst", "laddr", "raddr"}
+var portFields = []string{"port", "sport", "dport", "lport", "rport"}
+var protoFields = []string{"proto", "protocol"}
+
+// The local lists of Tor exit addresses and known bad addresses, set with
+// -tor-exits and -blocklist.
+var torExitFile string
+var blocklistFile string
+
+// ipClasses are the address ranges with a name of their own; anything else
+// is "public".
+var ipClasses = []struct {
+	class string
+	test  func(net.IP) bool
+}{
+	{"unspecified", net.IP.IsUnspecified},
+	{"loopback", net.IP.IsLoopback},
+	{"link-local", func(ip net.IP) bool { return ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() }},
+	{"multicast", net.IP.IsMulticast},
+	{"private", isPrivateIP}}
+
+var privateNets = mustParseCIDRs("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7")
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	var nets []*net.IPNet
+
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+
+		if err != nil {
+			panic(err)
+		}
+
+		nets = append(nets, ipnet)
+	}
+
+	return nets
+}
+
+// isPrivateIP covers the RFC 1918 and unique local ranges, and the shared
+// address space of carrier-grade NAT.
+func isPrivateIP(ip net.IP) bool {
+
+	for _, ipnet := range privateNets {
+
+		if ipnet.Contains(ip) {
+			return true
+		}
+
+	}
+
+	return false
+}
+
+func classifyIP(ip net.IP) string {
+
+	for _, c := range ipClasses {
+
+		if c.test(ip) {
+			return c.class
+		}
+
+	}
+
+	return "public"
+}
+
+// addrList is a list of addresses and networks read from a local file, which
+// is only read again when it changes.
+type addrList struct {
+	mtime time.Time
+	ips   map[string]bool
+	nets  []*net.IPNet
+}
+
+// load reads a list file: one address or network per line, with "#"
+// comments. Every word on a line that parses as an address or network is
+// listed and the others are skipped, so that Tor's exit-addresses format,
+// "ExitAddress 1.2.3.4 2024-03-08 22:09:55", can be used as it is.
+// It reports whether the file could be read.
+func (al *addrList) load(fname string) bool {
+
+	if len(fname) == 0 {
+		return false
+	}
+
+	fi, err := os.Stat(fname)
+
+	if err != nil {
+		return false
+	}
+
+	if al.ips != nil && fi.ModTime().Equal(al.mtime) {
+		return true
+	}
+
+	f, err := os.Open(fname)
+
+	if err != nil {
+		return false
+	}
+
+	defer f.Close()
+	ips := make(map[string]bool)
+	var nets []*net.IPNet
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		for _, word := range strings.Fields(line) {
+
+			if ip := net.ParseIP(word); ip != nil {
+				ips[ip.String()] = true
+			} else if _, ipnet, err := net.ParseCIDR(word); err == nil {
+				nets = append(nets, ipnet)
+			}
+
+		}
+
+	}
+
+	al.ips = ips
+	al.nets = nets
+	al.mtime = fi.ModTime()
+	return true
+}
+
+func (al *addrList) contains(ip net.IP) bool {
+
+	if al.ips[ip.String()] {
+		return true
+	}
+
+	for _, ipnet := range al.nets {
+
+		if ipnet.Contains(ip) {
+			return true
+		}
+
+	}
+
+	return false
+}
+
+var torExits addrList
+var blocklist addrList
+
+var servicesCache struct {
+	mtime time.Time
+	names map[string]string
+}
+
+// lookupService maps a port and protocol, such as "443/tcp", to its service
+// name using /etc/services, which is only read again when it changes.
+func lookupService(port, proto string) string {
+	fi, err := os.Stat(SERVICES_FILE)
+
+	if err != nil {
+		return ""
+	}
+
+	if servicesCache.names == nil || !fi.ModTime().Equal(servicesCache.mtime) {
+		f, err := os.Open(SERVICES_FILE)
+
+		if err != nil {
+			return ""
+		}
+
+		names := make(map[string]string)
+		scanner := bufio.NewScanner(f)
+
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+
+			if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+				continue
+			}
+
+			if _, ok := names[fields[1]]; !ok {
+				names[fields[1]] = fields[0]
+			}
+
+		}
+
+		f.Close()
+		servicesCache.names = names
+		servicesCache.mtime = fi.ModTime()
+	}
+
+	return servicesCache.names[port+"/"+proto]
+}
+
+func yesNo(b bool) string {
+
+	if b {
+		return "yes"
+	}
+
+	return "no"
+}
+
+// enrichNetwork labels every IP address field with <field>_class, and with
+// <field>_tor_exit and <field>_blocklisted if those lists are available, and
+// adds <field>_service with the service name of every port field. Like the
+// other enrichments, it replaces captures of these keys, and removes them
+// where it has nothing to add.
+func enrichNetwork(rmap map[string]string) {
+	haveTor := torExits.load(torExitFile)
+	haveBlocklist := blocklist.load(blocklistFile)
+
+	for _, key := range ipFields {
+		var class, torExit, blocklisted string
+		ip := net.ParseIP(strings.Trim(rmap[key], "[]"))
+
+		if ip != nil {
+			class = classifyIP(ip)
+
+			if haveTor {
+				torExit = yesNo(torExits.contains(ip))
+			}
+
+			if haveBlocklist {
+				blocklisted = yesNo(blocklist.contains(ip))
+			}
+
+		}
+
+		setEnriched(rmap, key+"_class", class)
+		setEnriched(rmap, key+"_tor_exit", torExit)
+		setEnriched(rmap, key+"_blocklisted", blocklisted)
+	}
+
+	proto := "tcp"
+
+	for _, key := range protoFields {
+
+		if val, ok := rmap[key]; ok && len(val) > 0 {
+			proto = strings.ToLower(val)
+			break
+		}
+
+	}
+
+	for _, key := range portFields {
+		var service string
+
+		if port, ok := rmap[key]; ok {
+			service = lookupService(port, proto)
+		}
+
+		setEnriched(rmap, key+"_service", service)
+	}
+
+}
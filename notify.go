@@ -0,0 +1,424 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/godbus/dbus"
+)
+
+const EVENT_NOTIFIER_NAME = "com.subgraph.EventNotifier"
+
+// NOTIFY_HELPER_CMD is the hidden subcommand sublogmon re-runs itself with,
+// as the user with the active session, to talk to that user's session bus.
+const NOTIFY_HELPER_CMD = "notify-helper"
+
+// NOTIFY_USER_RECHECK is how long the active user is trusted for without
+// hearing from logind, in case a signal was missed.
+const NOTIFY_USER_RECHECK = time.Minute
+
+// NOTIFY_GROUP_WINDOW is how soon an event has to recur to replace the
+// desktop notification of the last one with the same ID, rather than
+// getting one of its own.
+const NOTIFY_GROUP_WINDOW = 5 * time.Minute
+
+// NOTIFY_HELPER_TIMEOUT is how long the helper has to answer a request
+// before it is taken to be stuck, killed and started afresh.
+const NOTIFY_HELPER_TIMEOUT = 10 * time.Second
+
+// The command the helper is run with and how long it is waited for, which
+// tests replace.
+var notifyHelperArgv = []string{"/proc/self/exe", NOTIFY_HELPER_CMD}
+var notifyHelperTimeout = NOTIFY_HELPER_TIMEOUT
+
+// Urgency levels and icons of desktop notifications, by severity.
+var notifyUrgency = map[string]byte{"info": 0, "default": 1, "warning": 1, "alert": 2, "critical": 2}
+var notifyIcons = map[string]string{"info": "dialog-information", "default": "dialog-information", "warning": "dialog-warning", "alert": "dialog-warning", "critical": "dialog-error"}
+
+type notifyGroup struct {
+	id    uint32
+	count int
+	last  time.Time
+}
+
+// desktopNotifier is the sink that shows events as desktop notifications,
+// through org.freedesktop.Notifications on the session bus of the user with
+// the active graphical session, for systems without the Subgraph event
+// notifier. It follows the active session as users switch. The session bus
+// is not connected to as root, but by a helper process running as that
+// user, which is handed notifications one JSON line at a time.
+type desktopNotifier struct {
+	helper *exec.Cmd
+	enc    *json.Encoder
+	dec    *json.Decoder
+	uid    uint32
+	groups map[string]*notifyGroup
+}
+
+// notifyRequest and notifyResponse are what goes to and comes back from the
+// helper process for each notification.
+type notifyRequest struct {
+	Summary    string
+	Body       string
+	Icon       string
+	ReplacesID uint32
+	Urgency    byte
+}
+
+type notifyResponse struct {
+	ID    uint32
+	Error string `json:",omitempty"`
+}
+
+// activeSession caches the user of the active graphical session. It is
+// invalidated whenever logind announces a change to its sessions.
+var activeSession struct {
+	sync.Mutex
+	uid     uint32
+	ok      bool
+	checked time.Time
+}
+
+// nameAvailable reports whether a service is running on the system bus or
+// can be started by it.
+func nameAvailable(name string) bool {
+	conn, err := dbus.SystemBus()
+
+	if err != nil {
+		return false
+	}
+
+	var running bool
+
+	if conn.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, name).Store(&running) == nil && running {
+		return true
+	}
+
+	var names []string
+
+	if conn.BusObject().Call("org.freedesktop.DBus.ListActivatableNames", 0).Store(&names) != nil {
+		return false
+	}
+
+	for _, n := range names {
+
+		if n == name {
+			return true
+		}
+
+	}
+
+	return false
+}
+
+// activeUser asks logind for the user of the active graphical session.
+func activeUser() (uint32, bool) {
+	conn, err := dbus.SystemBus()
+
+	if err != nil {
+		return 0, false
+	}
+
+	var sessions []struct {
+		ID   string
+		UID  uint32
+		User string
+		Seat string
+		Path dbus.ObjectPath
+	}
+
+	err = conn.Object("org.freedesktop.login1", "/org/freedesktop/login1").Call("org.freedesktop.login1.Manager.ListSessions", 0).Store(&sessions)
+
+	if err != nil {
+		return 0, false
+	}
+
+	for _, s := range sessions {
+		obj := conn.Object("org.freedesktop.login1", s.Path)
+		active, err := obj.GetProperty("org.freedesktop.login1.Session.Active")
+
+		if err != nil || active.Value() != true {
+			continue
+		}
+
+		kind, err := obj.GetProperty("org.freedesktop.login1.Session.Type")
+
+		if err != nil {
+			continue
+		}
+
+		if kind.Value() == "x11" || kind.Value() == "wayland" || kind.Value() == "mir" {
+			return s.UID, true
+		}
+
+	}
+
+	return 0, false
+}
+
+// cachedActiveUser returns the user of the active graphical session, asking
+// logind again only after a change or once NOTIFY_USER_RECHECK has passed.
+func cachedActiveUser() (uint32, bool) {
+	activeSession.Lock()
+	defer activeSession.Unlock()
+
+	if activeSession.checked.IsZero() || time.Since(activeSession.checked) > NOTIFY_USER_RECHECK {
+		activeSession.uid, activeSession.ok = activeUser()
+		activeSession.checked = time.Now()
+	}
+
+	return activeSession.uid, activeSession.ok
+}
+
+// watchSessions has the cached active user forgotten whenever a session is
+// created or removed, or a session's properties, such as Active, change.
+func watchSessions() {
+	conn, err := dbus.SystemBus()
+
+	if err != nil {
+		return
+	}
+
+	for _, rule := range []string{
+		"type='signal',sender='org.freedesktop.login1',interface='org.freedesktop.login1.Manager'",
+		"type='signal',sender='org.freedesktop.login1',interface='org.freedesktop.DBus.Properties',member='PropertiesChanged'",
+	} {
+
+		if call := conn.BusObject().Call("org.freedesktop.DBus.AddMatch", 0, rule); call.Err != nil {
+			fmt.Printf("Warning: cannot follow logind sessions: %v\n", call.Err)
+		}
+
+	}
+
+	signals := make(chan *dbus.Signal, 16)
+	conn.Signal(signals)
+
+	go func() {
+
+		for sig := range signals {
+
+			if strings.HasPrefix(string(sig.Path), "/org/freedesktop/login1") {
+				activeSession.Lock()
+				activeSession.checked = time.Time{}
+				activeSession.Unlock()
+			}
+
+		}
+
+	}()
+
+}
+
+func newDesktopNotifier() *desktopNotifier {
+	watchSessions()
+	return &desktopNotifier{groups: make(map[string]*notifyGroup)}
+}
+
+func (dn *desktopNotifier) Name() string {
+	return "desktop notifications"
+}
+
+// connect makes sure a helper process is running as the user with the
+// active session. It reports false if there is no such user.
+func (dn *desktopNotifier) connect() (bool, error) {
+	uid, ok := cachedActiveUser()
+
+	if !ok {
+		return false, nil
+	}
+
+	if dn.helper != nil && uid == dn.uid {
+		return true, nil
+	}
+
+	dn.close()
+	u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10))
+
+	if err != nil {
+		return false, err
+	}
+
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+
+	if err != nil {
+		return false, err
+	}
+
+	var groups []uint32
+	gids, _ := u.GroupIds()
+
+	for _, g := range gids {
+
+		if n, err := strconv.ParseUint(g, 10, 32); err == nil {
+			groups = append(groups, uint32(n))
+		}
+
+	}
+
+	cmd := exec.Command(notifyHelperArgv[0], notifyHelperArgv[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: uid, Gid: uint32(gid), Groups: groups}}
+	cmd.Env = []string{fmt.Sprintf("DBUS_SESSION_BUS_ADDRESS=unix:path=/run/user/%d/bus", uid), "HOME=" + u.HomeDir}
+	cmd.Dir = "/"
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+
+	if err != nil {
+		return false, err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+
+	if err != nil {
+		return false, err
+	}
+
+	if err = cmd.Start(); err != nil {
+		return false, err
+	}
+
+	dn.helper = cmd
+	dn.enc = json.NewEncoder(stdin)
+	dn.dec = json.NewDecoder(stdout)
+	dn.uid = uid
+	dn.groups = make(map[string]*notifyGroup)
+	return true, nil
+}
+
+func (dn *desktopNotifier) close() {
+
+	if dn.helper != nil {
+		dn.helper.Process.Kill()
+		dn.helper.Wait()
+		dn.helper = nil
+	}
+
+}
+
+// Send shows an event with its title as the summary and its long form as the
+// body. An event that recurs soon after the last one with the same ID
+// replaces its notification, with a count of how many there have been. A
+// helper that fails or does not answer within notifyHelperTimeout is killed,
+// and a new one is started for the next event.
+func (dn *desktopNotifier) Send(ev *logEvent) error {
+	ok, err := dn.connect()
+
+	if !ok {
+		return err
+	}
+
+	now := time.Now()
+	group := dn.groups[ev.EventID]
+
+	if group == nil || now.Sub(group.last) > NOTIFY_GROUP_WINDOW {
+		group = &notifyGroup{}
+		dn.groups[ev.EventID] = group
+	}
+
+	group.count++
+	group.last = now
+	body := ev.LogLine
+
+	if group.count > 1 {
+		body += fmt.Sprintf("\n(%d times)", group.count)
+	}
+
+	severity := ev.LogLevel
+
+	if _, ok := notifyUrgency[severity]; !ok {
+		severity = "default"
+	}
+
+	req := notifyRequest{Summary: ev.Title, Body: body, Icon: notifyIcons[severity], ReplacesID: group.id, Urgency: notifyUrgency[severity]}
+	var resp notifyResponse
+
+	if err = dn.enc.Encode(&req); err == nil {
+		err = dn.receive(&resp)
+	}
+
+	if err != nil {
+		dn.close()
+		return fmt.Errorf("notification helper: %v", err)
+	}
+
+	if len(resp.Error) > 0 {
+		return errors.New(resp.Error)
+	}
+
+	group.id = resp.ID
+	return nil
+}
+
+// receive waits for the helper's answer to a request. A read still waiting
+// when it times out ends once the helper is killed.
+func (dn *desktopNotifier) receive(resp *notifyResponse) error {
+	var answer notifyResponse
+	done := make(chan error, 1)
+	dec := dn.dec
+
+	go func() {
+		done <- dec.Decode(&answer)
+	}()
+
+	select {
+	case err := <-done:
+		*resp = answer
+		return err
+	case <-time.After(notifyHelperTimeout):
+		return fmt.Errorf("no response in %v", notifyHelperTimeout)
+	}
+
+}
+
+// runNotifyHelper is the helper process: it shows the notifications it reads
+// from stdin on the session bus named in its environment, and writes back
+// each one's ID or error.
+func runNotifyHelper() int {
+	conn, err := dbus.SessionBus()
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", NOTIFY_HELPER_CMD, err)
+		return 1
+	}
+
+	obj := conn.Object("org.freedesktop.Notifications", "/org/freedesktop/Notifications")
+	dec := json.NewDecoder(os.Stdin)
+	enc := json.NewEncoder(os.Stdout)
+
+	for {
+		var req notifyRequest
+
+		if err := dec.Decode(&req); err != nil {
+
+			if err == io.EOF {
+				return 0
+			}
+
+			fmt.Fprintf(os.Stderr, "%s: %v\n", NOTIFY_HELPER_CMD, err)
+			return 1
+		}
+
+		var resp notifyResponse
+		hints := map[string]dbus.Variant{"urgency": dbus.MakeVariant(req.Urgency)}
+		err := obj.Call("org.freedesktop.Notifications.Notify", 0, "sublogmon", req.ReplacesID, req.Icon, req.Summary, req.Body, []string{}, hints, int32(-1)).Store(&resp.ID)
+
+		if err != nil {
+			resp.Error = err.Error()
+		}
+
+		if err := enc.Encode(&resp); err != nil {
+			return 1
+		}
+
+	}
+
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A recurring event replaces the notification the helper reported for the
+// last one, and the request carries what the helper needs to show it.
+func TestDesktopNotifierHelperProtocol(t *testing.T) {
+	activeSession.Lock()
+	activeSession.uid, activeSession.ok, activeSession.checked = 1000, true, time.Now()
+	activeSession.Unlock()
+
+	defer func() {
+		activeSession.Lock()
+		activeSession.checked = time.Time{}
+		activeSession.Unlock()
+	}()
+
+	toHelper, helperIn := io.Pipe()
+	helperOut, fromHelper := io.Pipe()
+	requests := make(chan notifyRequest, 2)
+
+	go func() {
+		dec := json.NewDecoder(toHelper)
+		enc := json.NewEncoder(fromHelper)
+
+		for id := uint32(7); ; id++ {
+			var req notifyRequest
+
+			if dec.Decode(&req) != nil {
+				return
+			}
+
+			requests <- req
+			enc.Encode(&notifyResponse{ID: id})
+		}
+
+	}()
+
+	dn := newTestNotifier(helperIn, helperOut)
+	ev := &logEvent{slmData: slmData{EventID: "grsec", LogLevel: "critical", LogLine: "grsec msg: denied", Metadata: map[string]string{}}, Title: "grsec"}
+
+	for i := 0; i < 2; i++ {
+
+		if err := dn.Send(ev); err != nil {
+			t.Fatal(err)
+		}
+
+	}
+
+	first, second := <-requests, <-requests
+
+	if first.ReplacesID != 0 || first.Summary != "grsec" || first.Urgency != 2 || first.Icon != "dialog-error" {
+		t.Errorf("got first request %+v", first)
+	}
+
+	if second.ReplacesID != 7 || second.Body != "grsec msg: denied\n(2 times)" {
+		t.Errorf("got second request %+v", second)
+	}
+
+}
+
+// A helper process that stops answering is killed, and the next event gets
+// a new one.
+func TestDesktopNotifierHelperTimeout(t *testing.T) {
+
+	if os.Getuid() != 0 {
+		t.Skip("the helper is started with the credentials of the active user, which needs root")
+	}
+
+	activeSession.Lock()
+	activeSession.uid, activeSession.ok, activeSession.checked = 0, true, time.Now()
+	activeSession.Unlock()
+
+	defer func() {
+		activeSession.Lock()
+		activeSession.checked = time.Time{}
+		activeSession.Unlock()
+	}()
+
+	// The fake helper logs each request and answers with its number, except
+	// that the first one started hangs on its second request.
+	dir := t.TempDir()
+	requests := filepath.Join(dir, "requests")
+	helper := filepath.Join(dir, "helper")
+	script := fmt.Sprintf(`#!/bin/sh
+n=0
+while read -r line; do
+	n=$((n+1))
+	printf '%%s\n' "$line" >> %[1]s
+	if [ $n -eq 2 ] && [ ! -e %[2]s.hung ]; then
+		touch %[2]s.hung
+		exec sleep 60
+	fi
+	echo "{\"ID\":$n}"
+done
+`, requests, helper)
+
+	if err := ioutil.WriteFile(helper, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	argv, timeout := notifyHelperArgv, notifyHelperTimeout
+	notifyHelperArgv, notifyHelperTimeout = []string{helper}, 200*time.Millisecond
+
+	defer func() { notifyHelperArgv, notifyHelperTimeout = argv, timeout }()
+
+	dn := &desktopNotifier{groups: make(map[string]*notifyGroup)}
+	defer dn.close()
+	ev := &logEvent{slmData: slmData{EventID: "grsec", LogLevel: "alert", LogLine: "grsec msg: denied", Metadata: map[string]string{}}, Title: "grsec"}
+
+	if err := dn.Send(ev); err != nil {
+		t.Fatal(err)
+	}
+
+	first := dn.helper
+
+	if err := dn.Send(ev); err == nil || !strings.Contains(err.Error(), "no response") {
+		t.Fatalf("got error %v from a helper that did not answer", err)
+	}
+
+	if dn.helper != nil {
+		t.Fatal("the stuck helper was not killed")
+	}
+
+	if err := dn.Send(ev); err != nil {
+		t.Fatal(err)
+	}
+
+	if dn.helper == nil || dn.helper == first {
+		t.Fatal("no new helper was started")
+	}
+
+	f, err := os.Open(requests)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+	var got []notifyRequest
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		var req notifyRequest
+
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			t.Fatalf("the helper was sent %q: %v", scanner.Text(), err)
+		}
+
+		got = append(got, req)
+	}
+
+	if len(got) != 3 {
+		t.Fatalf("the helpers got %d requests, want 3", len(got))
+	}
+
+	if got[0].Summary != "grsec" || got[0].Body != "grsec msg: denied" || got[0].Urgency != 2 || got[0].Icon != "dialog-warning" {
+		t.Errorf("got first request %+v", got[0])
+	}
+
+	if got[1].ReplacesID != 1 {
+		t.Errorf("got second request %+v, want it to replace notification 1", got[1])
+	}
+
+	if got[2].ReplacesID != 0 {
+		t.Errorf("got %+v, want the new helper to start a new notification", got[2])
+	}
+
+}
+
+// newTestNotifier returns a desktop notifier already connected, for the
+// active user, to a helper at the other end of the given pipes.
+func newTestNotifier(w io.Writer, r io.Reader) *desktopNotifier {
+	dn := &desktopNotifier{groups: make(map[string]*notifyGroup)}
+	dn.helper = &exec.Cmd{}
+	dn.enc = json.NewEncoder(w)
+	dn.dec = json.NewDecoder(r)
+	dn.uid = 1000
+	return dn
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const OZ_PROFILE_DIR = "/var/lib/oz/cells.d"
+
+// ozProfileDir is where oz profiles are read from.
+var ozProfileDir = OZ_PROFILE_DIR
+
+// OZ_INIT_NAME is the command name of the process oz starts as pid 1 of
+// every sandbox; its environment names the profile being run.
+const OZ_INIT_NAME = "oz-init"
+
+// ozProfile holds the parts of an oz profile needed to tell which profile an
+// executable belongs to.
+type ozProfile struct {
+	Name  string
+	Path  string
+	Paths []string
+}
+
+var ozCache struct {
+	mtime    time.Time
+	profiles map[string]string
+}
+
+// ozProfileForExe returns the name of the oz profile that runs an executable,
+// reading the profile directory again only when it has changed.
+func ozProfileForExe(exe string) string {
+	fi, err := os.Stat(ozProfileDir)
+
+	if err != nil {
+		return ""
+	}
+
+	if ozCache.profiles == nil || !fi.ModTime().Equal(ozCache.mtime) {
+		files, _ := filepath.Glob(filepath.Join(ozProfileDir, "*.json"))
+		profiles := make(map[string]string)
+
+		for _, fname := range files {
+			var prof ozProfile
+
+			data, err := ioutil.ReadFile(fname)
+
+			if err != nil || json.Unmarshal(data, &prof) != nil || len(prof.Name) == 0 {
+				continue
+			}
+
+			for _, path := range append(prof.Paths, prof.Path) {
+
+				if len(path) > 0 {
+					profiles[path] = prof.Name
+				}
+
+			}
+
+		}
+
+		ozCache.profiles = profiles
+		ozCache.mtime = fi.ModTime()
+	}
+
+	return ozCache.profiles[exe]
+}
+
+// ozProfileForPid finds the sandbox a running process is in by walking up to
+// the oz-init process of its sandbox.
+func ozProfileForPid(pid int) string {
+	cur := pid
+
+	for i := 0; i < MAX_PARENT_CHAIN && cur > 1; i++ {
+		comm, ppid, ok := procStat(cur)
+
+		if !ok {
+			return ""
+		}
+
+		if comm == OZ_INIT_NAME {
+			data, err := ioutil.ReadFile("/proc/" + strconv.Itoa(cur) + "/environ")
+
+			if err != nil {
+				return ""
+			}
+
+			for _, env := range strings.Split(string(data), "\x00") {
+
+				if strings.HasPrefix(env, "INIT_PROFILE=") {
+					return strings.TrimPrefix(env, "INIT_PROFILE=")
+				}
+
+			}
+
+			return ""
+		}
+
+		cur = ppid
+	}
+
+	return ""
+}
+
+// inOwnMountNamespace reports whether a process lives in a mount namespace
+// other than that of init, as sandboxed processes do.
+func inOwnMountNamespace(pid int) bool {
+	ns, err := os.Readlink("/proc/" + strconv.Itoa(pid) + "/ns/mnt")
+
+	if err != nil {
+		return false
+	}
+
+	initns, err := os.Readlink("/proc/1/ns/mnt")
+	return err == nil && ns != initns
+}
+
+// enrichSandbox adds "sandbox" with the oz profile the process behind an
+// event was running under, replacing any "sandbox" captured from the line.
+func enrichSandbox(rmap map[string]string) {
+	setEnriched(rmap, "sandbox", sandboxOf(rmap))
+}
+
+// sandboxOf works out the oz profile of an event's process. A live pid is
+// traced to its sandbox; otherwise, or if that fails, the executable is
+// looked up in the oz profiles. For a live process that is not in a separate
+// mount namespace, a matching profile does not mean it was sandboxed, so the
+// result is "".
+func sandboxOf(rmap map[string]string) string {
+	pid, _ := strconv.Atoi(rmap["pid"])
+
+	if pid > 0 {
+
+		if prof := ozProfileForPid(pid); len(prof) > 0 {
+			return prof
+		}
+
+	}
+
+	for _, key := range exeFields {
+		exe, ok := rmap[key]
+
+		if !ok {
+			continue
+		}
+
+		prof := ozProfileForExe(exe)
+
+		if len(prof) == 0 {
+			return ""
+		}
+
+		if pid > 0 && procAlive(pid) && !inOwnMountNamespace(pid) {
+			return ""
+		}
+
+		return prof
+	}
+
+	return ""
+}
+
+func procAlive(pid int) bool {
+	_, err := os.Stat("/proc/" + strconv.Itoa(pid))
+	return err == nil
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// A ParseFunc splits a log line into fields, or returns nil if it cannot.
+type ParseFunc func(line string) map[string]string
+
+type LineParser struct {
+	Name string
+	Func ParseFunc
+}
+
+var (
+	LineParsers = []LineParser{
+		{Name: "kv", Func: parseKV},
+		{Name: "logfmt", Func: parseLogfmt},
+		{Name: "json", Func: parseJSONLine}}
+)
+
+// plainLiteral matches Match values that are safe to use as a prefilter
+// literal whatever the quoting of the line they come from: they hold no
+// regexp metacharacters, nor anything a JSON encoder might escape.
+var plainLiteral = regexp.MustCompile(`^[A-Za-z0-9 _-]+$`)
+
+func findParser(name string) ParseFunc {
+
+	for i := 0; i < len(LineParsers); i++ {
+
+		if LineParsers[i].Name == name {
+			return LineParsers[i].Func
+		}
+
+	}
+
+	return nil
+}
+
+// setupParser resolves a filter's Parser and compiles its Match predicates,
+// which must match the whole value of the field they name.
+func setupParser(fil *LogFilter) error {
+	fil.parse = nil
+
+	if len(fil.Parser) > 0 && fil.Parser != "regex" {
+		fil.parse = findParser(fil.Parser)
+
+		if fil.parse == nil {
+			return fmt.Errorf("unknown Parser \"%s\"", fil.Parser)
+		}
+
+	} else if len(fil.Regexp) == 0 {
+		return fmt.Errorf("no Regexp")
+	}
+
+	fil.matchRegcomp = make(map[string]*regexp.Regexp)
+
+	for key, val := range fil.Match {
+		re, err := regexp.Compile("^(?:" + val + ")$")
+
+		if err != nil {
+			return fmt.Errorf("bad Match pattern for %s: %v", key, err)
+		}
+
+		fil.matchRegcomp[key] = re
+	}
+
+	return nil
+}
+
+// matchLiteral picks the longest plain Match value as a prefilter literal
+// for a filter that has no regexp to derive one from. Only values of fields
+// read from the body of the line as they are written count: header fields
+// may be made up or converted by the header parser, like the "program" of
+// kmsg records, and never occur in the line as they are matched.
+func matchLiteral(fil *LogFilter, src *LogAuditFile) string {
+	best := ""
+
+	for key, val := range fil.Match {
+
+		if hasHeaderField(src, key) {
+			continue
+		}
+
+		if plainLiteral.MatchString(val) && len(val) > len(best) {
+			best = val
+		}
+
+	}
+
+	return best
+}
+
+// scanKV adds the key=value pairs of a line to rmap. Values may be double
+// quoted, with backslash escapes, or single quoted; a single quoted value
+// that itself holds pairs, as in the msg='...' of audit user records, has
+// those added as well. Keys seen earlier win. With bare set, a key without a
+// value counts as "true", as logfmt has it; otherwise words without an "="
+// are skipped.
+func scanKV(line string, bare bool, rmap map[string]string) {
+	var nested []string
+	i := 0
+
+	for i < len(line) {
+
+		for i < len(line) && line[i] == ' ' {
+			i++
+		}
+
+		start := i
+
+		for i < len(line) && line[i] != '=' && line[i] != ' ' && line[i] != '"' {
+			i++
+		}
+
+		key := line[start:i]
+
+		if i >= len(line) || line[i] != '=' {
+
+			if bare && len(key) > 0 && (i >= len(line) || line[i] == ' ') {
+
+				if _, ok := rmap[key]; !ok {
+					rmap[key] = "true"
+				}
+
+			}
+
+			for i < len(line) && line[i] != ' ' {
+				i++
+			}
+
+			continue
+		}
+
+		i++
+		var val string
+
+		switch {
+		case i < len(line) && line[i] == '"':
+			var sb strings.Builder
+			i++
+
+			for i < len(line) && line[i] != '"' {
+
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+				}
+
+				sb.WriteByte(line[i])
+				i++
+			}
+
+			i++
+			val = sb.String()
+		case i < len(line) && line[i] == '\'':
+			end := strings.IndexByte(line[i+1:], '\'')
+
+			if end < 0 {
+				end = len(line) - i - 1
+			}
+
+			val = line[i+1 : i+1+end]
+			i += end + 2
+
+			if strings.Contains(val, "=") {
+				nested = append(nested, val)
+			}
+
+		default:
+			vstart := i
+
+			for i < len(line) && line[i] != ' ' {
+				i++
+			}
+
+			val = line[vstart:i]
+		}
+
+		if len(key) > 0 {
+
+			if _, ok := rmap[key]; !ok {
+				rmap[key] = val
+			}
+
+		}
+
+	}
+
+	for _, val := range nested {
+		scanKV(val, bare, rmap)
+	}
+
+}
+
+// parseKV handles key=value lines such as audit records and kernel apparmor
+// messages. Anything before the first pair, like a syslog header, is ignored.
+func parseKV(line string) map[string]string {
+	rmap := make(map[string]string)
+	scanKV(line, false, rmap)
+
+	if len(rmap) == 0 {
+		return nil
+	}
+
+	return rmap
+}
+
+func parseLogfmt(line string) map[string]string {
+	rmap := make(map[string]string)
+	scanKV(line, true, rmap)
+
+	if len(rmap) == 0 {
+		return nil
+	}
+
+	return rmap
+}
+
+// parseJSONLine handles lines holding a JSON object, possibly after a syslog
+// header. Nested objects are flattened into dotted keys; arrays are kept as
+// JSON text.
+func parseJSONLine(line string) map[string]string {
+	start := strings.IndexByte(line, '{')
+
+	if start < 0 {
+		return nil
+	}
+
+	var obj map[string]interface{}
+
+	dec := json.NewDecoder(strings.NewReader(line[start:]))
+	dec.UseNumber()
+
+	if dec.Decode(&obj) != nil {
+		return nil
+	}
+
+	rmap := make(map[string]string)
+	flattenJSON("", obj, rmap)
+	return rmap
+}
+
+func flattenJSON(prefix string, obj map[string]interface{}, rmap map[string]string) {
+
+	for key, val := range obj {
+
+		switch v := val.(type) {
+		case map[string]interface{}:
+			flattenJSON(prefix+key+".", v, rmap)
+		case string:
+			rmap[prefix+key] = v
+		case nil:
+			rmap[prefix+key] = ""
+		default:
+			data, _ := json.Marshal(v)
+			rmap[prefix+key] = string(data)
+		}
+
+	}
+
+}
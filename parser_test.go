@@ -0,0 +1,129 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseKV(t *testing.T) {
+	tests := []struct {
+		line string
+		want map[string]string
+	}{
+		{`a=1 b=two c=`, map[string]string{"a": "1", "b": "two", "c": ""}},
+		{`apparmor="DENIED" operation="open" name="/etc/my file"`,
+			map[string]string{"apparmor": "DENIED", "operation": "open", "name": "/etc/my file"}},
+		{`msg="said \"hi\" to C:\\path" next=1`, map[string]string{"msg": `said "hi" to C:\path`, "next": "1"}},
+		{`comm='foo bar' x=1`, map[string]string{"comm": "foo bar", "x": "1"}},
+		{`unterminated="to the end`, map[string]string{"unterminated": "to the end"}},
+		{`a=1 a=2`, map[string]string{"a": "1"}},
+		{`Mar  8 22:09:55 subgraph kernel: audit: type=1400 words in between pid=42`,
+			map[string]string{"type": "1400", "pid": "42"}},
+		// The msg='...' of audit user records holds pairs of its own, which
+		// do not override those of the record.
+		{`type=USER_AUTH pid=1234 uid=0 msg='op=PAM:authentication acct="root" exe="/usr/bin/su" pid=99 res=failed'`,
+			map[string]string{"type": "USER_AUTH", "pid": "1234", "uid": "0", "op": "PAM:authentication", "acct": "root", "exe": "/usr/bin/su", "res": "failed",
+				"msg": `op=PAM:authentication acct="root" exe="/usr/bin/su" pid=99 res=failed`}},
+		{`msg='no pairs here'`, map[string]string{"msg": "no pairs here"}},
+		{`no pairs at all`, nil},
+		{``, nil},
+	}
+
+	for _, test := range tests {
+
+		if got := parseKV(test.line); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %v, want %v", test.line, got, test.want)
+		}
+
+	}
+
+}
+
+func TestParseLogfmt(t *testing.T) {
+	tests := []struct {
+		line string
+		want map[string]string
+	}{
+		{`level=warn msg="disk full" dry_run`, map[string]string{"level": "warn", "msg": "disk full", "dry_run": "true"}},
+		{`debug verbose=false`, map[string]string{"debug": "true", "verbose": "false"}},
+		{`verbose verbose=false`, map[string]string{"verbose": "true"}},
+		{`at=info "quoted" path=/`, map[string]string{"at": "info", "path": "/"}},
+		{``, nil},
+	}
+
+	for _, test := range tests {
+
+		if got := parseLogfmt(test.line); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %v, want %v", test.line, got, test.want)
+		}
+
+	}
+
+}
+
+func TestParseJSONLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want map[string]string
+	}{
+		{`{"level":"warn","port":8080,"ratio":0.5,"ok":true,"none":null}`,
+			map[string]string{"level": "warn", "port": "8080", "ratio": "0.5", "ok": "true", "none": ""}},
+		{`Mar  8 22:09:55 subgraph app[1]: {"src":{"ip":"10.0.0.1","geo":{"cc":"NL"}},"dst":{}}`,
+			map[string]string{"src.ip": "10.0.0.1", "src.geo.cc": "NL"}},
+		{`{"tags":["a","b"],"ports":[22,443],"hosts":[{"name":"x"}]}`,
+			map[string]string{"tags": `["a","b"]`, "ports": "[22,443]", "hosts": `[{"name":"x"}]`}},
+		{`{"id":12345678901234567890}`, map[string]string{"id": "12345678901234567890"}},
+		{`{"truncated":`, nil},
+		{`["not","an","object"]`, nil},
+		{`no json`, nil},
+	}
+
+	for _, test := range tests {
+
+		if got := parseJSONLine(test.line); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %v, want %v", test.line, got, test.want)
+		}
+
+	}
+
+}
+
+// Match predicates must match the whole value of their field, which may come
+// from the parser or from the header.
+func TestMatchPredicate(t *testing.T) {
+	fil := &LogFilter{ID: "test", Parser: "kv", Match: map[string]string{"apparmor": "DENIED|AUDIT", "program": "kernel"}}
+
+	if err := setupParser(fil); err != nil {
+		t.Fatal(err)
+	}
+
+	header := map[string]string{"program": "kernel"}
+	tests := []struct {
+		line   string
+		header map[string]string
+		ok     bool
+	}{
+		{`apparmor="DENIED" operation="open"`, header, true},
+		{`apparmor="AUDIT" operation="open"`, header, true},
+		{`apparmor="ALLOWED" operation="open"`, header, false},
+		{`apparmor="DENIED_LATER" operation="open"`, header, false},
+		{`apparmor="NOT DENIED" operation="open"`, header, false},
+		{`operation="open"`, header, false},
+		{`apparmor="DENIED" operation="open"`, map[string]string{"program": "kernel-audit"}, false},
+		{`apparmor="DENIED" operation="open"`, nil, false},
+		{`no fields`, header, false},
+	}
+
+	for _, test := range tests {
+
+		if rmap := matchFilter(fil, test.line, test.header); (rmap != nil) != test.ok {
+			t.Errorf("%q with header %v: got %v", test.line, test.header, rmap)
+		}
+
+	}
+
+	if err := setupParser(&LogFilter{ID: "bad", Parser: "kv", Match: map[string]string{"a": "("}}); err == nil {
+		t.Error("a bad Match pattern was accepted")
+	}
+
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"regexp/syntax"
+	"strings"
+)
+
+// requiredLiteral returns the longest literal string that any text matched
+// by a parsed regexp must contain, or "" if there is no such literal.
+func requiredLiteral(re *syntax.Regexp) string {
+
+	switch re.Op {
+	case syntax.OpLiteral:
+
+		if re.Flags&syntax.FoldCase != 0 {
+			return ""
+		}
+
+		return string(re.Rune)
+	case syntax.OpCapture, syntax.OpPlus:
+		return requiredLiteral(re.Sub[0])
+	case syntax.OpRepeat:
+
+		if re.Min < 1 {
+			return ""
+		}
+
+		return requiredLiteral(re.Sub[0])
+	case syntax.OpConcat:
+		best := ""
+
+		for _, sub := range re.Sub {
+
+			if lit := requiredLiteral(sub); len(lit) > len(best) {
+				best = lit
+			}
+
+		}
+
+		return best
+	}
+
+	return ""
+}
+
+// deriveContains works out a literal prefilter for a filter regexp. Failing
+// to find one is not an error; the filter is then simply always tried.
+func deriveContains(expr string) string {
+	re, err := syntax.Parse(expr, syntax.Perl)
+
+	if err != nil {
+		return ""
+	}
+
+	return requiredLiteral(re.Simplify())
+}
+
+// acMatcher is an Aho-Corasick automaton that finds which of a set of
+// literal strings occur in a line with a single pass over it.
+type acMatcher struct {
+	next  [][256]int32
+	out   [][]int
+	npats int
+}
+
+func newACMatcher(patterns []string) *acMatcher {
+	ac := &acMatcher{npats: len(patterns)}
+	ac.addState()
+
+	for p, pat := range patterns {
+		s := int32(0)
+
+		for i := 0; i < len(pat); i++ {
+
+			if ac.next[s][pat[i]] == -1 {
+				ac.next[s][pat[i]] = ac.addState()
+			}
+
+			s = ac.next[s][pat[i]]
+		}
+
+		ac.out[s] = append(ac.out[s], p)
+	}
+
+	// Breadth first, turn the trie into a complete transition table by
+	// following failure links.
+	fail := make([]int32, len(ac.next))
+	queue := []int32{}
+
+	for c := 0; c < 256; c++ {
+
+		if t := ac.next[0][c]; t == -1 {
+			ac.next[0][c] = 0
+		} else {
+			queue = append(queue, t)
+		}
+
+	}
+
+	for len(queue) > 0 {
+		s := queue[0]
+		queue = queue[1:]
+		ac.out[s] = append(ac.out[s], ac.out[fail[s]]...)
+
+		for c := 0; c < 256; c++ {
+
+			if t := ac.next[s][c]; t == -1 {
+				ac.next[s][c] = ac.next[fail[s]][c]
+			} else {
+				fail[t] = ac.next[fail[s]][c]
+				queue = append(queue, t)
+			}
+
+		}
+
+	}
+
+	return ac
+}
+
+func (ac *acMatcher) addState() int32 {
+	var row [256]int32
+
+	for i := range row {
+		row[i] = -1
+	}
+
+	ac.next = append(ac.next, row)
+	ac.out = append(ac.out, nil)
+	return int32(len(ac.next) - 1)
+}
+
+// scan returns which patterns occur in line, and whether any of them did.
+func (ac *acMatcher) scan(line string) ([]bool, bool) {
+	var found []bool
+	s := int32(0)
+
+	for i := 0; i < len(line); i++ {
+		s = ac.next[s][line[i]]
+
+		if len(ac.out[s]) == 0 {
+			continue
+		}
+
+		if found == nil {
+			found = make([]bool, ac.npats)
+		}
+
+		for _, p := range ac.out[s] {
+			found[p] = true
+		}
+
+	}
+
+	return found, found != nil
+}
+
+// setupPrefilters fills in each filter's Contains literal, deriving it from
+// the regexp when the config does not give one, and builds the source-wide
+// matcher. The matcher can only be used if every filter has a literal, since
+// otherwise no line can be rejected without running the remaining regexps.
+func setupPrefilters(src *LogAuditFile) {
+	var patterns []string
+	ids := make(map[string]int)
+	complete := true
+	src.prefilter = nil
+
+	for j := 0; j < len(src.Filters); j++ {
+		fil := &src.Filters[j]
+
+		if len(fil.Contains) == 0 {
+			fil.Contains = deriveContains(fil.Regexp)
+		}
+
+		if len(fil.Contains) == 0 {
+			fil.Contains = matchLiteral(fil, src)
+		}
+
+		if len(fil.Contains) == 0 {
+			complete = false
+			continue
+		}
+
+		id, ok := ids[fil.Contains]
+
+		if !ok {
+			id = len(patterns)
+			ids[fil.Contains] = id
+			patterns = append(patterns, fil.Contains)
+		}
+
+		fil.containsID = id
+	}
+
+	if complete && len(patterns) > 0 {
+		src.prefilter = newACMatcher(patterns)
+	}
+
+}
+
+// prefilterLine decides which of a source's filters are worth running on a
+// line. It returns false if none are; otherwise tryFilter reports, per filter
+// index, whether that filter's regexp needs to be run.
+func prefilterLine(src *LogAuditFile, line string) (tryFilter func(int) bool, any bool) {
+
+	if src.prefilter != nil {
+		found, any := src.prefilter.scan(line)
+
+		if !any {
+			return nil, false
+		}
+
+		return func(j int) bool { return found[src.Filters[j].containsID] }, true
+	}
+
+	return func(j int) bool {
+		lit := src.Filters[j].Contains
+		return len(lit) == 0 || strings.Contains(line, lit)
+	}, true
+}
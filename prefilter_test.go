@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRequiredLiteral(t *testing.T) {
+	tests := []struct {
+		expr string
+		lit  string
+	}{
+		{`grsec: (?P<grsecmsg>.+)`, "grsec: "},
+		{`.+grsec: (?P<grsecmsg>.+)`, "grsec: "},
+		{`.+kernel:.+grsec: denied (?P<action>.+?) .+ for (?P<process>.+?)\[.+`, "grsec: denied "},
+		{`.+roflcoptor.+DENY: \[(?P<application>.+)\].+`, "roflcoptor"},
+		{`(?:DENY)+ \d+`, "DENY"},
+		{`x(?:abc){2,5}`, "abc"},
+		{`(?:abc)?def`, "def"},
+		{`(?:abc)*`, ""},
+		// The parser factors out the common prefix of alternatives.
+		{`DENY|DROP`, "D"},
+		{`DENY|ACCEPT`, ""},
+		{`(?P<verdict>DENY|DROP): (?P<host>\S+)`, ": "},
+		{`foo|foobar`, "foo"},
+		{`(?i)denied`, ""},
+		{`(?i:denied) by (?P<msg>.+)`, " by "},
+		{`.+`, ""},
+		{`[`, ""},
+	}
+
+	for _, test := range tests {
+
+		if lit := deriveContains(test.expr); lit != test.lit {
+			t.Errorf("%s: got %q, want %q", test.expr, lit, test.lit)
+		}
+
+	}
+
+}
+
+func TestACMatcher(t *testing.T) {
+	ac := newACMatcher([]string{"he", "she", "his", "hers"})
+
+	tests := []struct {
+		line  string
+		found []bool
+	}{
+		{"ushers", []bool{true, true, false, true}},
+		{"this", []bool{false, false, true, false}},
+		{"h", nil},
+		{"", nil},
+		{"xxhexx", []bool{true, false, false, false}},
+	}
+
+	for _, test := range tests {
+		found, any := ac.scan(test.line)
+
+		if any != (test.found != nil) {
+			t.Errorf("%q: got any %v", test.line, any)
+			continue
+		}
+
+		for p := range test.found {
+
+			if found[p] != test.found[p] {
+				t.Errorf("%q: pattern %d: got %v, want %v", test.line, p, found[p], test.found[p])
+			}
+
+		}
+
+	}
+
+}
+
+// The matcher has to agree with strings.Contains for every pattern, including
+// ones that overlap or are contained in each other.
+func TestACMatcherAgreesWithContains(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	word := func(n int) string {
+		b := make([]byte, n)
+
+		for i := range b {
+			b[i] = "abc"[rnd.Intn(3)]
+		}
+
+		return string(b)
+	}
+
+	for round := 0; round < 200; round++ {
+		var patterns []string
+
+		for i := 0; i < 1+rnd.Intn(6); i++ {
+			patterns = append(patterns, word(1+rnd.Intn(4)))
+		}
+
+		ac := newACMatcher(patterns)
+		line := word(rnd.Intn(30))
+		found, any := ac.scan(line)
+		wantAny := false
+
+		for p, pat := range patterns {
+			want := strings.Contains(line, pat)
+			wantAny = wantAny || want
+
+			if want != (found != nil && found[p]) {
+				t.Fatalf("patterns %q, line %q: pattern %q found %v, want %v", patterns, line, pat, !want, want)
+			}
+
+		}
+
+		if any != wantAny {
+			t.Fatalf("patterns %q, line %q: got any %v, want %v", patterns, line, any, wantAny)
+		}
+
+	}
+
+}
+
+func TestPrefilterLine(t *testing.T) {
+	logs := loadTestConfig(t, `[
+{ "Description": "test", "PathName": "/tmp/test.log",
+  "Filters": [
+    { "ID": "a", "Regexp": "grsec: (?P<msg>.+)", "OutputStr": "{msg}" },
+    { "ID": "b", "Regexp": "DENY (?P<msg>.+)",   "OutputStr": "{msg}" }
+  ]
+}]`)
+	src := &logs[0]
+
+	if src.prefilter == nil {
+		t.Fatal("no combined prefilter although every filter has a literal")
+	}
+
+	if _, any := prefilterLine(src, "nothing here"); any {
+		t.Error("a line without any literal was not rejected")
+	}
+
+	tryFilter, any := prefilterLine(src, "fw: DENY 1.2.3.4")
+
+	if !any || tryFilter(0) || !tryFilter(1) {
+		t.Error("only the filter whose literal occurs should be tried")
+	}
+
+}
+
+// A Match value only makes a prefilter literal if it is in the line as
+// written: not for a header field the header parser makes up, nor a value
+// that is a regexp.
+func TestMatchLiteral(t *testing.T) {
+	logs := loadTestConfig(t, `[
+{ "Description": "kmsg", "SourceName": "kmsg", "PathName": "/dev/kmsg", "Format": "kmsg",
+  "Filters": [
+    { "ID": "kernel-audit", "Parser": "kv", "Match": { "program": "kernel", "type": "1400" }, "OutputStr": "{apparmor}" }
+  ]
+},
+{ "Description": "app", "SourceName": "app", "PathName": "/tmp/app.log",
+  "Filters": [
+    { "ID": "addr", "Parser": "kv", "Match": { "addr": "10.0.0.1", "op": "connect" }, "OutputStr": "{op} {addr}" }
+  ]
+}]`)
+
+	tests := []struct {
+		src      string
+		contains string
+		line     string
+	}{
+		{"kmsg", "1400", `6,339,5140900,-;audit: type=1400 audit(1520000000.123:42): apparmor="DENIED"`},
+		{"app", "connect", "op=connect addr=10-0-0-1"},
+	}
+
+	for _, test := range tests {
+		src := findSource(t, logs, test.src)
+
+		if got := src.Filters[0].Contains; got != test.contains {
+			t.Errorf("%s: got literal %q, want %q", test.src, got, test.contains)
+		}
+
+		if events := runLines(src, test.line); len(events) != 1 {
+			t.Errorf("%s: got %d events for %q, want 1", test.src, len(events), test.line)
+		}
+
+	}
+
+}
+
+// readSample reads the sample syslog the benchmarks run on.
+func readSample(b *testing.B) []string {
+	f, err := os.Open("testdata/syslog.sample")
+
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	if err := scanner.Err(); err != nil {
+		b.Fatal(err)
+	}
+
+	return lines
+}
+
+// benchmarkSources runs the sample syslog through the shipped kernel and
+// syslog sources, optionally with their prefilters taken out.
+func benchmarkSources(b *testing.B, prefilter bool) {
+	logs, _, err := loadConfig("sublogmon.json", "", "", false)
+
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	srcs := []*LogAuditFile{findSource(b, logs, "kernel"), findSource(b, logs, "syslog")}
+
+	if !prefilter {
+
+		for _, src := range srcs {
+			src.prefilter = nil
+
+			for j := 0; j < len(src.Filters); j++ {
+				src.Filters[j].Contains = ""
+			}
+
+		}
+
+	}
+
+	lines := readSample(b)
+	tail := &logTail{PathName: "testdata/syslog.sample"}
+
+	// Events raised by the sample would otherwise be printed.
+	devnull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = devnull
+
+	defer func() {
+		os.Stdout = stdout
+		devnull.Close()
+	}()
+
+	sinks = nil
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+
+		for _, line := range lines {
+
+			for _, src := range srcs {
+				processLine(src, tail, line)
+			}
+
+		}
+
+	}
+
+}
+
+func BenchmarkProcessLine(b *testing.B) {
+	b.Run("prefilter", func(b *testing.B) { benchmarkSources(b, true) })
+	b.Run("no-prefilter", func(b *testing.B) { benchmarkSources(b, false) })
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// fieldFlags collects repeated -field key=value options.
+type fieldFlags map[string]string
+
+func (ff fieldFlags) String() string {
+	var items []string
+
+	for key, val := range ff {
+		items = append(items, key+"="+val)
+	}
+
+	return strings.Join(items, ",")
+}
+
+func (ff fieldFlags) Set(val string) error {
+	parts := strings.SplitN(val, "=", 2)
+
+	if len(parts) != 2 || len(parts[0]) == 0 {
+		return fmt.Errorf("expected key=value, not \"%s\"", val)
+	}
+
+	ff[parts[0]] = parts[1]
+	return nil
+}
+
+func queryUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: "+progName+" query [options]     where")
+	fmt.Fprintln(os.Stderr, "  -history:  the history directory to search (\"sublogmon.history\" by default),")
+	fmt.Fprintln(os.Stderr, "  -since:    only events at or after this time (e.g. \"2017-03-08\", \"2017-03-08T22:00:00Z\" or \"2h\" for two hours ago),")
+	fmt.Fprintln(os.Stderr, "  -until:    only events at or before this time,")
+	fmt.Fprintln(os.Stderr, "  -id:       only events raised by this filter,")
+	fmt.Fprintln(os.Stderr, "  -severity: only events of this severity,")
+	fmt.Fprintln(os.Stderr, "  -source:   only events from this log source,")
+	fmt.Fprintln(os.Stderr, "  -field:    only events with this metadata key containing this value (key=value, may be repeated),")
+	fmt.Fprintln(os.Stderr, "  -limit:    show at most this many of the latest matching events (0 for all),")
+	fmt.Fprintln(os.Stderr, "  -json:     print events as JSON lines instead of a table,")
+}
+
+// runQuery implements "sublogmon query", returning the exit status.
+func runQuery(args []string) int {
+	fs := flag.NewFlagSet("query", flag.ContinueOnError)
+	fs.Usage = queryUsage
+
+	var dir = fs.String("history", "sublogmon.history", "History directory to search")
+	var since = fs.String("since", "", "Only events at or after this time")
+	var until = fs.String("until", "", "Only events at or before this time")
+	var limit = fs.Int("limit", 0, "Show at most this many events")
+	var asJSON = fs.Bool("json", false, "Print events as JSON lines")
+	q := historyQuery{fields: make(fieldFlags)}
+	fs.StringVar(&q.id, "id", "", "Only events raised by this filter")
+	fs.StringVar(&q.severity, "severity", "", "Only events of this severity")
+	fs.StringVar(&q.source, "source", "", "Only events from this log source")
+	fs.Var(fieldFlags(q.fields), "field", "Only events with metadata key=value")
+
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		return 2
+	}
+
+	var err error
+
+	if len(*since) > 0 {
+
+		if q.since, err = parseHistoryTime(*since); err != nil {
+			fmt.Fprintln(os.Stderr, "Error: ", err)
+			return 2
+		}
+
+	}
+
+	if len(*until) > 0 {
+
+		if q.until, err = parseHistoryTime(*until); err != nil {
+			fmt.Fprintln(os.Stderr, "Error: ", err)
+			return 2
+		}
+
+	}
+
+	var found []*historyRecord
+
+	err = readHistory(*dir, func(rec *historyRecord) {
+
+		if q.matches(rec) {
+			found = append(found, rec)
+		}
+
+	})
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading history: ", err)
+		return 1
+	}
+
+	if *limit > 0 && len(found) > *limit {
+		found = found[len(found)-*limit:]
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+
+		for _, rec := range found {
+			enc.Encode(rec)
+		}
+
+		return 0
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tSEVERITY\tID\tSOURCE\tOUTPUT")
+
+	for _, rec := range found {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", rec.Time.Local().Format("2006-01-02 15:04:05"), rec.Severity, rec.EventID, rec.Source, rec.Output)
+	}
+
+	tw.Flush()
+	return 0
+}
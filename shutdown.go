@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// tailState is what is remembered about a followed file across restarts, so
+// that lines written while sublogmon was not running are not missed.
+type tailState struct {
+	PathName string
+	Inode    uint64
+	Offset   int64
+	Backlog  string
+}
+
+func fileInode(fi os.FileInfo) uint64 {
+
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Ino
+	}
+
+	return 0
+}
+
+// tailPosition returns how far a followed file has been read.
+func tailPosition(tail *logTail) (tailState, bool) {
+	offset, err := tail.f.Seek(0, os.SEEK_CUR)
+
+	if err != nil {
+		return tailState{}, false
+	}
+
+	fi, err := tail.f.Stat()
+
+	if err != nil {
+		return tailState{}, false
+	}
+
+	return tailState{tail.PathName, fileInode(fi), offset, tail.Backlog}, true
+}
+
+// resumeTail moves a followed file back to a position read earlier, provided
+// it is still the same file and has not shrunk since.
+func resumeTail(tail *logTail, st tailState, debug bool) bool {
+	fi, err := tail.f.Stat()
+
+	if err != nil || fileInode(fi) != st.Inode || fi.Size() < st.Offset {
+
+		if debug {
+			fmt.Println("Saved position no longer valid for", st.PathName)
+		}
+
+		return false
+	}
+
+	if _, err = tail.f.Seek(st.Offset, os.SEEK_SET); err != nil {
+		return false
+	}
+
+	tail.Backlog = st.Backlog
+
+	if debug {
+		fmt.Printf("Resuming %s at offset %d (%d bytes unread)\n", st.PathName, st.Offset, fi.Size()-st.Offset)
+	}
+
+	return true
+}
+
+// saveState records the read position of every followed file. The file is
+// written under a temporary name and renamed so that a crash never leaves a
+// half written state behind.
+func saveState(statefile string) error {
+	var states []tailState
+
+	for i := 0; i < len(AuditLogs); i++ {
+
+		for _, tail := range AuditLogs[i].tails {
+
+			if st, ok := tailPosition(tail); ok {
+				states = append(states, st)
+			}
+
+		}
+
+	}
+
+	data, err := json.MarshalIndent(states, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	tmpfile := filepath.Join(filepath.Dir(statefile), "."+filepath.Base(statefile)+".tmp")
+	err = ioutil.WriteFile(tmpfile, data, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpfile, statefile)
+}
+
+// restoreState moves every followed file back to the position saved by the
+// previous run, provided it is still the same file and has not shrunk since.
+// It returns the tails that were restored; these may have unread lines.
+func restoreState(statefile string, debug bool) []*logTail {
+	var states []tailState
+	var restored []*logTail
+
+	data, err := ioutil.ReadFile(statefile)
+
+	if err != nil {
+		return nil
+	}
+
+	err = json.Unmarshal(data, &states)
+
+	if err != nil {
+		fmt.Println("Warning: ignoring unreadable state file: ", err)
+		return nil
+	}
+
+	for _, st := range states {
+		_, tail := findTail(st.PathName)
+
+		if tail == nil {
+			continue
+		}
+
+		if resumeTail(tail, st, debug) {
+			restored = append(restored, tail)
+		}
+
+	}
+
+	return restored
+}
+
+// printSummary prints how often each filter matched and each suppression
+// applied over the lifetime of the process.
+func printSummary() {
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	fmt.Println("Filter match summary:")
+
+	ids := make([]string, 0, len(metrics.matches))
+
+	for id := range metrics.matches {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		fmt.Printf("  %-30s %d\n", id, metrics.matches[id])
+	}
+
+	if len(metrics.suppressed) > 0 {
+		fmt.Println("Suppressed events:")
+		descs := make([]string, 0, len(metrics.suppressed))
+
+		for desc := range metrics.suppressed {
+			descs = append(descs, desc)
+		}
+
+		sort.Strings(descs)
+
+		for _, desc := range descs {
+			fmt.Printf("  %-30s %d\n", desc, metrics.suppressed[desc])
+		}
+
+	}
+
+}
+
+// shutdown finishes up after a SIGINT or SIGTERM, once the watchers have been
+// stopped: it saves the read position of every file, waits for the output
+// sinks to deliver the events they have queued and prints a summary. If this
+// takes longer than timeout, the process exits regardless.
+func shutdown(sig os.Signal, statefile string, timeout time.Duration) {
+	flushRepeats()
+	fmt.Printf("\nReceived %v, shutting down...\n", sig)
+	deadline := time.Now().Add(timeout)
+
+	time.AfterFunc(timeout, func() {
+		fmt.Fprintln(os.Stderr, "Shutdown deadline exceeded; exiting anyway.")
+		os.Exit(1)
+	})
+
+	if len(statefile) > 0 {
+
+		if err := saveState(statefile); err != nil {
+			fmt.Println("Error saving state: ", err)
+		}
+
+	}
+
+	if late := flushSinks(deadline); len(late) > 0 {
+		fmt.Println("Warning: some queued events were not delivered by: ", late)
+	}
+
+	for i := 0; i < len(AuditLogs); i++ {
+
+		for _, tail := range AuditLogs[i].tails {
+			tail.f.Close()
+		}
+
+	}
+
+	printSummary()
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// followTestLog sets up a source that raises an event with the text of every
+// line of a file, and follows the file from its start.
+func followTestLog(t *testing.T, pathname string) *LogAuditFile {
+	logs := loadTestConfig(t, fmt.Sprintf(`[ { "SourceName": "test", "PathName": %q,
+	  "Filters": [ { "ID": "line", "Regexp": "(?P<text>.+)", "OutputStr": "{text}" } ] } ]`, pathname))
+	AuditLogs = logs
+	t.Cleanup(func() { AuditLogs = nil })
+	src := &AuditLogs[0]
+	reopenTestLog(t, src)
+	return src
+}
+
+// reopenTestLog stands for a restart: the file is opened again from its
+// start, with nothing held back.
+func reopenTestLog(t *testing.T, src *LogAuditFile) *logTail {
+
+	if tail, ok := src.tails[src.PathName]; ok {
+		tail.f.Close()
+	}
+
+	f, err := os.Open(src.PathName)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tail := &logTail{PathName: src.PathName, f: f}
+	src.tails = map[string]*logTail{src.PathName: tail}
+	t.Cleanup(func() { f.Close() })
+	return tail
+}
+
+// readTestLog reads a source's file up to its end and returns the text of
+// the events raised.
+func readTestLog(t *testing.T, src *LogAuditFile) []string {
+	rs := &recordSink{}
+	sinks = []*sinkQueue{newSinkQueue(rs)}
+	tail := src.tails[src.PathName]
+	dbuf := make([]byte, 4096)
+
+	for {
+		n, err := readTail(src, tail, dbuf)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n == 0 {
+			break
+		}
+
+	}
+
+	flushSinks(time.Now().Add(5 * time.Second))
+	var out []string
+
+	for _, ev := range rs.events {
+		out = append(out, ev.Output)
+	}
+
+	return out
+}
+
+func appendTestLog(t *testing.T, pathname, data string) {
+	f, err := os.OpenFile(pathname, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	if _, err = f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+
+}
+
+// Lines written while sublogmon was down are read after a restart, and so is
+// a line it had only read the start of.
+func TestRestoreStateResumes(t *testing.T) {
+	dir := t.TempDir()
+	pathname := filepath.Join(dir, "test.log")
+	statefile := filepath.Join(dir, "state.json")
+	appendTestLog(t, pathname, "one\ntwo\nthe start of three")
+	src := followTestLog(t, pathname)
+
+	if got := readTestLog(t, src); !reflect.DeepEqual(got, []string{"one", "two"}) {
+		t.Fatalf("got %q", got)
+	}
+
+	if err := saveState(statefile); err != nil {
+		t.Fatal(err)
+	}
+
+	appendTestLog(t, pathname, " and its end\nfour\n")
+	tail := reopenTestLog(t, src)
+	restored := restoreState(statefile, false)
+
+	if len(restored) != 1 || restored[0] != tail {
+		t.Fatalf("got %d tails restored, want 1", len(restored))
+	}
+
+	if tail.Backlog != "the start of three" {
+		t.Errorf("got backlog %q", tail.Backlog)
+	}
+
+	if got := readTestLog(t, src); !reflect.DeepEqual(got, []string{"the start of three and its end", "four"}) {
+		t.Errorf("got %q after the restart", got)
+	}
+
+}
+
+// A saved position is not used for a file that was replaced or cut short;
+// such a file is read as it is.
+func TestRestoreStateInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(t *testing.T, pathname string)
+	}{
+		{"inode changed", func(t *testing.T, pathname string) {
+			newfile := pathname + ".new"
+
+			if err := ioutil.WriteFile(newfile, []byte("one\ntwo\nthree\nfour\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := os.Rename(newfile, pathname); err != nil {
+				t.Fatal(err)
+			}
+
+		}},
+		{"file shrank", func(t *testing.T, pathname string) {
+
+			if err := os.Truncate(pathname, 4); err != nil {
+				t.Fatal(err)
+			}
+
+		}},
+	}
+
+	for _, test := range tests {
+		dir := t.TempDir()
+		pathname := filepath.Join(dir, "test.log")
+		statefile := filepath.Join(dir, "state.json")
+		appendTestLog(t, pathname, "one\ntwo\nthree")
+		src := followTestLog(t, pathname)
+		readTestLog(t, src)
+
+		if err := saveState(statefile); err != nil {
+			t.Fatal(err)
+		}
+
+		test.change(t, pathname)
+		tail := reopenTestLog(t, src)
+
+		if restored := restoreState(statefile, false); len(restored) != 0 {
+			t.Errorf("%s: the saved position was used", test.name)
+		}
+
+		if tail.Backlog != "" {
+			t.Errorf("%s: got backlog %q from the old file", test.name, tail.Backlog)
+		}
+
+		if offset, _ := tail.f.Seek(0, os.SEEK_CUR); offset != 0 {
+			t.Errorf("%s: the file was moved to offset %d", test.name, offset)
+		}
+
+	}
+
+}
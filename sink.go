@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// SINK_QUEUE_SIZE is how many events may be waiting for a slow sink before
+// further ones are dropped.
+const SINK_QUEUE_SIZE = 256
+
+// logEvent is an event on its way to the sinks: what is sent over D-Bus,
+// with the long form of the output in LogLine, plus the text rendered for
+// each other kind of output. Output is the plain OutputStr, which is what
+// suppressions are matched against; Source is the log source it came from.
+// Typed holds the values of fields with a declared type.
+type logEvent struct {
+	slmData
+	Source  string
+	Output  string
+	Title   string
+	Console string
+	Syslog  string
+	Typed   map[string]interface{}
+}
+
+// eventSink is somewhere events are delivered to besides the console.
+type eventSink interface {
+	Name() string
+	Send(ev *logEvent) error
+}
+
+// sinkFlusher is implemented by sinks that hold on to events, to send what
+// they have before sublogmon exits.
+type sinkFlusher interface {
+	Flush() error
+}
+
+// sinkQueue delivers events to a sink on its own goroutine so that a slow
+// or hung sink never holds up reading the logs.
+type sinkQueue struct {
+	sink  eventSink
+	queue chan *logEvent
+	done  chan struct{}
+}
+
+var sinks []*sinkQueue
+
+func newSinkQueue(sink eventSink) *sinkQueue {
+	q := &sinkQueue{sink: sink, queue: make(chan *logEvent, SINK_QUEUE_SIZE), done: make(chan struct{})}
+
+	go func() {
+
+		for ev := range q.queue {
+
+			if err := q.sink.Send(ev); err != nil {
+				fmt.Printf("Error delivering event %s to %s: %v\n", ev.EventID, q.sink.Name(), err)
+			}
+
+		}
+
+		if f, ok := q.sink.(sinkFlusher); ok {
+
+			if err := f.Flush(); err != nil {
+				fmt.Printf("Error flushing %s: %v\n", q.sink.Name(), err)
+			}
+
+		}
+
+		close(q.done)
+	}()
+
+	return q
+}
+
+func addSink(sink eventSink) {
+	sinks = append(sinks, newSinkQueue(sink))
+}
+
+func (q *sinkQueue) enqueue(ev *logEvent) {
+
+	select {
+	case q.queue <- ev:
+	default:
+		fmt.Printf("Warning: %s is not keeping up; dropped event %s\n", q.sink.Name(), ev.EventID)
+	}
+
+}
+
+// deliverEvent hands an event to every configured sink.
+func deliverEvent(ev *logEvent) {
+
+	for _, q := range sinks {
+		q.enqueue(ev)
+	}
+
+}
+
+// flushSinks stops accepting events and waits until every sink has delivered
+// what it already has queued, or until the deadline passes. It returns the
+// names of the sinks that did not finish in time.
+func flushSinks(deadline time.Time) []string {
+	var late []string
+
+	for _, q := range sinks {
+		close(q.queue)
+	}
+
+	for _, q := range sinks {
+
+		select {
+		case <-q.done:
+		case <-time.After(time.Until(deadline)):
+			late = append(late, q.sink.Name())
+		}
+
+	}
+
+	sinks = nil
+	return late
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	inotify "github.com/subgraph/inotify"
+)
+
+// A source is active while all of its files are being followed. When its file
+// does not exist (yet) it is waiting for it, and when opening or reading it
+// fails for any other reason it is errored. Sources that are not active are
+// retried with exponential backoff.
+const (
+	SOURCE_ACTIVE  = "active"
+	SOURCE_WAITING = "waiting-for-file"
+	SOURCE_ERRORED = "errored"
+)
+
+const MIN_RETRY_DELAY = time.Second
+const MAX_RETRY_DELAY = time.Minute
+
+// INTERNAL_EVENT_PREFIX starts the EventID of every event that sublogmon
+// raises about itself rather than about a log line.
+const INTERNAL_EVENT_PREFIX = "sublogmon-"
+
+// emitInternal reports a problem with sublogmon itself, through the same
+// channels as the events it finds in the logs.
+func emitInternal(id, severity, msg string, metadata map[string]string) {
+
+	if metadata == nil {
+		metadata = make(map[string]string)
+	}
+
+	if dash == nil {
+		flushRepeats()
+		fmt.Println("* ", colorize(severityColors[severity], "sublogmon: "+msg))
+	}
+
+	deliverEvent(newInternalEvent(id, severity, msg, metadata))
+}
+
+func newInternalEvent(id, severity, msg string, metadata map[string]string) *logEvent {
+	now := time.Now().UnixNano()
+	data := slmData{INTERNAL_EVENT_PREFIX + id, severity, now, msg, "", metadata, now}
+	return &logEvent{slmData: data, Source: metadata["source"], Output: msg, Title: "sublogmon: " + msg, Console: msg, Syslog: msg}
+}
+
+// setSourceStatus records the outcome of trying to follow a source. Internal
+// events are only raised when the status actually changes, so a file that
+// stays missing is reported once rather than at every retry. A file briefly
+// missing while it is being rotated is not reported at all.
+func setSourceStatus(src *LogAuditFile, status string, err error) {
+
+	if status == SOURCE_ACTIVE {
+		src.retryDelay = 0
+	} else {
+
+		if src.retryDelay == 0 {
+			src.retryDelay = MIN_RETRY_DELAY
+		} else {
+			src.retryDelay *= 2
+		}
+
+		if src.retryDelay > MAX_RETRY_DELAY {
+			src.retryDelay = MAX_RETRY_DELAY
+		}
+
+		src.retryAt = time.Now().Add(src.retryDelay)
+	}
+
+	src.status = status
+	metrics.setStatus(src)
+
+	if status == SOURCE_WAITING && time.Since(src.rotatedAt) < ROTATION_WINDOW {
+		return
+	}
+
+	prev := src.announced
+
+	if prev == status {
+		return
+	}
+
+	src.announced = status
+
+	meta := map[string]string{"source": sourceLabel(src), "logfile": src.PathName, "status": status}
+
+	switch status {
+	case SOURCE_WAITING:
+		emitInternal("source-waiting", "warning", fmt.Sprintf("log file for %s does not exist; waiting for it to appear", src.Description), meta)
+	case SOURCE_ERRORED:
+		meta["error"] = err.Error()
+		emitInternal("source-error", "alert", fmt.Sprintf("monitoring of %s failed: %v", src.Description, err), meta)
+	case SOURCE_ACTIVE:
+
+		if len(prev) > 0 {
+			emitInternal("source-recovered", "info", fmt.Sprintf("monitoring of %s has resumed", src.Description), meta)
+		}
+
+	}
+
+}
+
+// startSource tries to follow all of a source's files and sets its status to
+// match the outcome.
+func startSource(watcher *inotify.Watcher, src *LogAuditFile, atEnd bool, debug bool) {
+	err := openSource(watcher, src, atEnd, debug)
+
+	if err == nil {
+		setSourceStatus(src, SOURCE_ACTIVE, nil)
+	} else if os.IsNotExist(err) {
+		setSourceStatus(src, SOURCE_WAITING, err)
+	} else {
+		setSourceStatus(src, SOURCE_ERRORED, err)
+	}
+
+}
+
+// failTail stops following a file that could not be read or reopened; the
+// source is retried later. How far the file had been read is kept, to go on
+// from there if the same file can be opened again.
+func failTail(watcher *inotify.Watcher, src *LogAuditFile, tail *logTail, err error) {
+
+	if st, ok := tailPosition(tail); ok {
+
+		if src.lost == nil {
+			src.lost = make(map[string]tailState)
+		}
+
+		src.lost[tail.PathName] = st
+	}
+
+	removeTail(watcher, src, tail.PathName)
+
+	if os.IsNotExist(err) {
+		setSourceStatus(src, SOURCE_WAITING, err)
+	} else {
+		setSourceStatus(src, SOURCE_ERRORED, err)
+	}
+
+}
+
+// watchDirs adds inotify watches for any directories of the given sources
+// that are not watched yet. Directories that do not exist are skipped; the
+// retry loop picks up their files once they appear.
+func watchDirs(watcher *inotify.Watcher, parentDirs map[string]bool, logs []LogAuditFile, debug bool) {
+
+	for dname := range logParentDirs(logs) {
+
+		if parentDirs[dname] {
+			continue
+		}
+
+		if debug {
+			fmt.Println("Adding inotify watcher for parent directory events:", dname)
+		}
+
+		err := watcher.AddWatch(dname, inotify.IN_ALL_EVENTS|inotify.IN_ISDIR)
+
+		if err != nil {
+
+			if debug {
+				fmt.Println("Could not set up watcher on log file directory: ", err)
+			}
+
+			continue
+		}
+
+		parentDirs[dname] = true
+	}
+
+}
+
+// retrySources tries again to follow every source that is not active and is
+// due for a retry. A file that failed is read on from where it was left if it
+// is still the same file; a file that was missing is read from its beginning
+// once it shows up, since everything in it is new, and any other file from
+// its end.
+func retrySources(watcher *inotify.Watcher, parentDirs map[string]bool, debug bool) {
+	now := time.Now()
+
+	for i := 0; i < len(AuditLogs); i++ {
+		src := &AuditLogs[i]
+
+		if src.status == SOURCE_ACTIVE || now.Before(src.retryAt) {
+			continue
+		}
+
+		startSource(watcher, src, src.status != SOURCE_WAITING, debug)
+
+		if src.status == SOURCE_ACTIVE {
+			resumeLost(src, debug)
+		}
+
+	}
+
+	watchDirs(watcher, parentDirs, AuditLogs, debug)
+}
+
+// resumeLost takes up the files of a source that is following them again
+// where they were left when they failed.
+func resumeLost(src *LogAuditFile, debug bool) {
+
+	for pathname, st := range src.lost {
+
+		if tail, ok := src.tails[pathname]; ok {
+			resumeTail(tail, st, debug)
+		}
+
+	}
+
+	src.lost = nil
+}
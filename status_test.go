@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	inotify "github.com/subgraph/inotify"
+)
+
+// A file that failed is read on from where it was left once it can be read
+// again, unless it has been replaced in the meantime.
+func TestRetryResumesFailedFile(t *testing.T) {
+	watcher, err := inotify.NewWatcher()
+
+	if err != nil {
+		t.Skip("inotify is not available: ", err)
+	}
+
+	defer watcher.Close()
+	dir := t.TempDir()
+	pathname := filepath.Join(dir, "test.log")
+	appendTestLog(t, pathname, "one\n")
+	logs := loadTestConfig(t, fmt.Sprintf(`[ { "Description": "test log", "SourceName": "test", "PathName": %q,
+	  "Filters": [ { "ID": "line", "Regexp": "(?P<text>.+)", "OutputStr": "{text}" } ] } ]`, pathname))
+	AuditLogs = logs
+	defer func() { AuditLogs = nil }()
+	src := &AuditLogs[0]
+	parentDirs := make(map[string]bool)
+	startSource(watcher, src, false, false)
+	defer closeSource(watcher, src)
+
+	if got := readTestLog(t, src); !reflect.DeepEqual(got, []string{"one"}) {
+		t.Fatalf("got %q", got)
+	}
+
+	appendTestLog(t, pathname, "two\nthe start of three")
+	readTestLog(t, src)
+	failTail(watcher, src, src.tails[pathname], errors.New("read failed"))
+	appendTestLog(t, pathname, " and its end\n")
+	src.retryAt = time.Time{}
+	retrySources(watcher, parentDirs, false)
+
+	if src.status != SOURCE_ACTIVE {
+		t.Fatalf("got status %s", src.status)
+	}
+
+	if got := readTestLog(t, src); !reflect.DeepEqual(got, []string{"the start of three and its end"}) {
+		t.Errorf("got %q after the same file was opened again", got)
+	}
+
+	failTail(watcher, src, src.tails[pathname], errors.New("read failed"))
+	newfile := pathname + ".new"
+
+	if err := ioutil.WriteFile(newfile, []byte("old news\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Rename(newfile, pathname); err != nil {
+		t.Fatal(err)
+	}
+
+	src.retryAt = time.Time{}
+	retrySources(watcher, parentDirs, false)
+	appendTestLog(t, pathname, "four\n")
+
+	if got := readTestLog(t, src); !reflect.DeepEqual(got, []string{"four"}) {
+		t.Errorf("got %q after the file was replaced", got)
+	}
+
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"log/syslog"
+)
+
+// syslogSink forwards events to the local syslog daemon. It logs to the
+// authpriv facility, which normally ends up in auth.log, so that sublogmon
+// does not read back its own messages from the logs it monitors.
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func newSyslogSink() (*syslogSink, error) {
+	w, err := syslog.New(syslog.LOG_AUTHPRIV|syslog.LOG_NOTICE, "sublogmon")
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &syslogSink{w}, nil
+}
+
+func (s *syslogSink) Name() string {
+	return "syslog"
+}
+
+func (s *syslogSink) Send(ev *logEvent) error {
+	msg := "[" + ev.EventID + "] " + ev.Syslog
+
+	switch ev.LogLevel {
+	case "critical":
+		return s.w.Crit(msg)
+	case "alert":
+		return s.w.Alert(msg)
+	case "warning":
+		return s.w.Warning(msg)
+	case "info":
+		return s.w.Info(msg)
+	}
+
+	return s.w.Notice(msg)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	inotify "github.com/subgraph/inotify"
+)
+
+// logTail is a single concrete file being followed on behalf of a
+// LogAuditFile. A source with a plain PathName has exactly one; a source
+// whose PathName is a glob pattern has one per matching file.
+type logTail struct {
+	PathName string
+	f        *os.File
+	Backlog  string
+	ident    fileIdentity
+}
+
+func isGlobPattern(pathname string) bool {
+	return strings.ContainsAny(pathname, "*?[")
+}
+
+// sourceFiles returns the files that currently belong to a log source.
+func sourceFiles(src *LogAuditFile) ([]string, error) {
+
+	if !isGlobPattern(src.PathName) {
+		return []string{src.PathName}, nil
+	}
+
+	return filepath.Glob(src.PathName)
+}
+
+// sourceDirs returns the directories a log source lives in. If the directory
+// part of a glob pattern is itself a pattern, it is expanded to the
+// directories that exist right now.
+func sourceDirs(src *LogAuditFile) []string {
+	dir := filepath.Dir(src.PathName)
+
+	if !isGlobPattern(dir) {
+		return []string{dir}
+	}
+
+	dirs, _ := filepath.Glob(dir)
+	return dirs
+}
+
+// matchesSource reports whether a concrete file name is covered by a source.
+func matchesSource(src *LogAuditFile, pathname string) bool {
+
+	if !isGlobPattern(src.PathName) {
+		return src.PathName == pathname
+	}
+
+	ok, _ := filepath.Match(src.PathName, pathname)
+	return ok
+}
+
+// addTail opens a file for a source and starts watching it. Files that exist
+// when monitoring starts are read from their end; files that appear later are
+// read from the beginning since everything in them is new.
+func addTail(watcher *inotify.Watcher, src *LogAuditFile, pathname string, atEnd bool) error {
+	var f *os.File
+	var err error
+
+	if atEnd {
+		f, err = openLogFile(pathname)
+	} else {
+		f, err = os.OpenFile(pathname, os.O_RDONLY, 0666)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	err = watcher.AddWatch(pathname, inotify.IN_ALL_EVENTS)
+
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("could not set up watcher on log file: %v", err)
+	}
+
+	if src.tails == nil {
+		src.tails = make(map[string]*logTail)
+	}
+
+	tail := &logTail{PathName: pathname, f: f}
+	recordIdentity(tail)
+	src.tails[pathname] = tail
+	return nil
+}
+
+// followedElsewhere reports whether a file is also followed by a source other
+// than src. Watches are per file, so its watch has to stay in that case.
+func followedElsewhere(src *LogAuditFile, pathname string) bool {
+
+	for i := 0; i < len(AuditLogs); i++ {
+
+		if &AuditLogs[i] == src {
+			continue
+		}
+
+		if _, ok := AuditLogs[i].tails[pathname]; ok {
+			return true
+		}
+
+	}
+
+	return false
+}
+
+// removeTail stops following one of a source's files.
+func removeTail(watcher *inotify.Watcher, src *LogAuditFile, pathname string) {
+	tail, ok := src.tails[pathname]
+
+	if !ok {
+		return
+	}
+
+	if !followedElsewhere(src, pathname) {
+		watcher.RemoveWatch(pathname)
+	}
+
+	tail.f.Close()
+	delete(src.tails, pathname)
+}
+
+// findTail looks up the source and tail that a concrete file name belongs to.
+func findTail(pathname string) (*LogAuditFile, *logTail) {
+
+	for i := 0; i < len(AuditLogs); i++ {
+
+		if tail, ok := AuditLogs[i].tails[pathname]; ok {
+			return &AuditLogs[i], tail
+		}
+
+	}
+
+	return nil, nil
+}
+
+// findSourceFor returns the source, if any, that a newly seen file should be
+// added to: a glob source it matches, or a source waiting for exactly that
+// file to appear.
+func findSourceFor(pathname string) *LogAuditFile {
+
+	for i := 0; i < len(AuditLogs); i++ {
+
+		if _, ok := AuditLogs[i].tails[pathname]; ok {
+			continue
+		}
+
+		if matchesSource(&AuditLogs[i], pathname) {
+			return &AuditLogs[i]
+		}
+
+	}
+
+	return nil
+}
+
+// readTail reads the next chunk of new data from a file and runs every line
+// completed by it through the source's filters. Whatever follows the last
+// newline is kept in the Backlog until the rest of the line arrives. It
+// returns the number of bytes read, which is 0 once the end of the file has
+// been reached, along with any read error.
+func readTail(src *LogAuditFile, tail *logTail, dbuf []byte) (int, error) {
+	nread, err := tail.f.Read(dbuf)
+
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+
+	if nread == 0 {
+		_, err := tail.f.Seek(0, os.SEEK_END)
+
+		if err != nil {
+			fmt.Println("Seek failed: ", err)
+		}
+
+		return 0, nil
+	}
+
+	metrics.countRead(src, nread)
+	tail.Backlog += string(dbuf[:nread])
+	nIndex := strings.Index(tail.Backlog, "\n")
+
+	for nIndex != -1 {
+		curLine := tail.Backlog[0:nIndex]
+		tail.Backlog = tail.Backlog[nIndex+1:]
+		nIndex = strings.Index(tail.Backlog, "\n")
+
+		started := time.Now()
+		noteLine(src)
+		processLine(src, tail, curLine)
+		metrics.countLine(src, time.Since(started))
+	}
+
+	metrics.setBacklog(src)
+	return nread, nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ROTATION_WINDOW is how recently a rotated copy of a log file (syslog.1,
+// audit.log-20170308, ...) must have been written for a deletion or
+// truncation of the live file to be put down to log rotation.
+const ROTATION_WINDOW = 2 * time.Minute
+
+// fileIdentity is what a followed file looked like when it was last checked.
+type fileIdentity struct {
+	ino     uint64
+	mode    os.FileMode
+	uid     uint32
+	gid     uint32
+	symlink bool
+}
+
+// pendingMove is a rename of a followed file; the IN_MOVED_TO with the same
+// cookie, if any, tells where it went. Moves are kept by the path of the
+// file rather than by its source, which a config reload may replace before
+// the move is settled.
+type pendingMove struct {
+	cookie uint32
+	seen   time.Time
+}
+
+var pendingMoves = make(map[string]pendingMove)
+
+func identify(pathname string) (fileIdentity, error) {
+	var id fileIdentity
+
+	fi, err := os.Lstat(pathname)
+
+	if err != nil {
+		return id, err
+	}
+
+	id.symlink = fi.Mode()&os.ModeSymlink != 0
+
+	if id.symlink {
+		fi, err = os.Stat(pathname)
+
+		if err != nil {
+			return id, err
+		}
+
+	}
+
+	id.mode = fi.Mode().Perm()
+
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		id.ino = st.Ino
+		id.uid = st.Uid
+		id.gid = st.Gid
+	}
+
+	return id, nil
+}
+
+// recordIdentity remembers what a followed file looks like right after it
+// has been opened.
+func recordIdentity(tail *logTail) {
+	id, err := identify(tail.PathName)
+
+	if err == nil {
+		tail.ident = id
+	}
+
+}
+
+// isRotatedName reports whether newpath looks like a rotated copy of pathname.
+func isRotatedName(pathname, newpath string) bool {
+	dir, base := filepath.Split(pathname)
+	ndir, nbase := filepath.Split(newpath)
+
+	if dir != ndir || nbase == base {
+		return false
+	}
+
+	return strings.HasPrefix(nbase, base+".") || strings.HasPrefix(nbase, base+"-")
+}
+
+// recentlyRotated reports whether a rotated copy of a file was written to
+// within the rotation window.
+func recentlyRotated(pathname string) bool {
+	entries, err := ioutil.ReadDir(filepath.Dir(pathname))
+
+	if err != nil {
+		return false
+	}
+
+	for _, fi := range entries {
+
+		if isRotatedName(pathname, filepath.Join(filepath.Dir(pathname), fi.Name())) && time.Since(fi.ModTime()) < ROTATION_WINDOW {
+			return true
+		}
+
+	}
+
+	return false
+}
+
+func tamperEvent(src *LogAuditFile, pathname, kind, msg string) {
+	meta := map[string]string{"source": sourceLabel(src), "logfile": pathname, "tamper": kind}
+	emitInternal("tamper-"+kind, "critical", msg, meta)
+}
+
+// compareIdentity raises an event for every way in which a followed file has
+// changed in a way that log files should not, and remembers its new state.
+// Nothing is compared if what the file looked like was never recorded.
+func compareIdentity(src *LogAuditFile, tail *logTail, id fileIdentity) {
+	old := tail.ident
+	tail.ident = id
+
+	if old == (fileIdentity{}) {
+		return
+	}
+
+	if id.symlink && !old.symlink {
+		tamperEvent(src, tail.PathName, "symlink", fmt.Sprintf("log file %s has been replaced by a symbolic link", tail.PathName))
+	}
+
+	if id.mode != old.mode {
+		tamperEvent(src, tail.PathName, "permissions", fmt.Sprintf("permissions of log file %s changed from %v to %v", tail.PathName, old.mode, id.mode))
+	}
+
+	if id.uid != old.uid || id.gid != old.gid {
+		tamperEvent(src, tail.PathName, "ownership", fmt.Sprintf("ownership of log file %s changed from %d:%d to %d:%d", tail.PathName, old.uid, old.gid, id.uid, id.gid))
+	}
+
+}
+
+// checkAttrib handles IN_ATTRIB on a followed file.
+func checkAttrib(src *LogAuditFile, tail *logTail) {
+	id, err := identify(tail.PathName)
+
+	// A different inode is a rotation in progress; that is dealt with by
+	// checkReplaced once the new file has been opened.
+	if err != nil || (id.ino != tail.ident.ino && !id.symlink && tail.ident != (fileIdentity{})) {
+		return
+	}
+
+	compareIdentity(src, tail, id)
+}
+
+// checkReplaced is called after a followed file has been reopened because
+// it was rotated. The new file should look like the old one did.
+func checkReplaced(src *LogAuditFile, tail *logTail) {
+	id, err := identify(tail.PathName)
+
+	if err == nil {
+		compareIdentity(src, tail, id)
+	}
+
+}
+
+// checkShrink catches a followed file becoming shorter than what has already
+// been read from it. Truncation to nothing right after a rotated copy was
+// written is how copytruncate rotation works; anything else means lines were
+// removed. Either way reading resumes from the new start of the file.
+func checkShrink(src *LogAuditFile, tail *logTail) {
+	offset, err := tail.f.Seek(0, os.SEEK_CUR)
+
+	if err != nil {
+		return
+	}
+
+	fi, err := tail.f.Stat()
+
+	if err != nil || fi.Size() >= offset {
+		return
+	}
+
+	if fi.Size() != 0 || !recentlyRotated(tail.PathName) {
+		tamperEvent(src, tail.PathName, "truncated", fmt.Sprintf("log file %s shrank from %d to %d bytes", tail.PathName, offset, fi.Size()))
+	} else {
+		metrics.countRotation(src)
+	}
+
+	tail.f.Seek(0, os.SEEK_SET)
+	tail.Backlog = ""
+}
+
+// checkDeleted handles the deletion of a followed file. Log rotation deletes
+// only old, already rotated copies, so the live file vanishing without a
+// fresh rotated copy next to it is suspicious.
+func checkDeleted(src *LogAuditFile, tail *logTail) {
+
+	if _, err := os.Lstat(tail.PathName); err == nil {
+		return
+	}
+
+	if !recentlyRotated(tail.PathName) {
+		tamperEvent(src, tail.PathName, "deleted", fmt.Sprintf("log file %s was deleted", tail.PathName))
+	}
+
+}
+
+// noteMovedFrom remembers that a followed file was renamed, to be checked
+// against where it ends up.
+func noteMovedFrom(tail *logTail, cookie uint32) {
+	pendingMoves[tail.PathName] = pendingMove{cookie, time.Now()}
+}
+
+// movedSource returns the source a renamed file belongs to now, which is
+// nil if it is no longer followed.
+func movedSource(pathname string) *LogAuditFile {
+
+	if src, _ := findTail(pathname); src != nil {
+		return src
+	}
+
+	return findSourceFor(pathname)
+}
+
+// checkMovedTo is called for every IN_MOVED_TO in a watched directory. If
+// it completes the rename of a followed file, the new name must look like a
+// rotated copy.
+func checkMovedTo(newpath string, cookie uint32) {
+
+	for pathname, mv := range pendingMoves {
+
+		if mv.cookie != cookie {
+			continue
+		}
+
+		delete(pendingMoves, pathname)
+		src := movedSource(pathname)
+
+		if src != nil && !isRotatedName(pathname, newpath) {
+			tamperEvent(src, pathname, "renamed", fmt.Sprintf("log file %s was renamed to %s", pathname, newpath))
+		}
+
+		return
+	}
+
+}
+
+// expirePendingMoves deals with renames whose IN_MOVED_TO never arrived,
+// which means the file was moved out of the watched directory altogether.
+func expirePendingMoves(now time.Time) {
+
+	for pathname, mv := range pendingMoves {
+
+		if now.Sub(mv.seen) < time.Second {
+			continue
+		}
+
+		delete(pendingMoves, pathname)
+
+		if src := movedSource(pathname); src != nil {
+			tamperEvent(src, pathname, "renamed", fmt.Sprintf("log file %s was moved out of its directory", pathname))
+		}
+
+	}
+
+}
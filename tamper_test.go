@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// tamperEvents runs f and returns the tamper events it raised.
+func tamperEvents(f func()) []*logEvent {
+	rs := &recordSink{}
+	sinks = []*sinkQueue{newSinkQueue(rs)}
+	f()
+	flushSinks(time.Now().Add(5 * time.Second))
+	return rs.events
+}
+
+// A rename is reported under the source that follows the file when the
+// rename is settled, even if the config was reloaded in between, and not at
+// all if the file is no longer followed.
+func TestPendingMoveAcrossReload(t *testing.T) {
+	pathname := "/var/log/test.log"
+	tail := &logTail{PathName: pathname}
+	AuditLogs = []LogAuditFile{{SourceName: "before", PathName: pathname, tails: map[string]*logTail{pathname: tail}}}
+	defer func() { AuditLogs = nil }()
+
+	noteMovedFrom(tail, 7)
+	AuditLogs = []LogAuditFile{{SourceName: "after", PathName: pathname, tails: map[string]*logTail{pathname: tail}}}
+
+	events := tamperEvents(func() {
+		checkMovedTo("/var/log/test.log.1", 8)
+		checkMovedTo("/tmp/hidden.log", 7)
+	})
+
+	if len(events) != 1 || events[0].Metadata["source"] != "after" || events[0].Metadata["tamper"] != "renamed" {
+		t.Fatalf("got %d events, want one rename in source after: %v", len(events), events)
+	}
+
+	if len(pendingMoves) != 0 {
+		t.Errorf("%d moves still pending", len(pendingMoves))
+	}
+
+	noteMovedFrom(tail, 9)
+	AuditLogs = []LogAuditFile{{SourceName: "other", PathName: "/var/log/other.log"}}
+
+	if events = tamperEvents(func() { expirePendingMoves(time.Now().Add(time.Minute)) }); len(events) != 0 {
+		t.Errorf("got %v for a file no longer followed", events)
+	}
+
+	if len(pendingMoves) != 0 {
+		t.Errorf("%d moves still pending", len(pendingMoves))
+	}
+
+}
+
+// A file whose identity was never recorded gets its first one recorded
+// instead of being compared against nothing.
+func TestAttribWithoutBaseline(t *testing.T) {
+	pathname := filepath.Join(t.TempDir(), "test.log")
+
+	if err := ioutil.WriteFile(pathname, nil, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	src := &LogAuditFile{SourceName: "test", PathName: pathname}
+	tail := &logTail{PathName: pathname}
+
+	if events := tamperEvents(func() { checkAttrib(src, tail) }); len(events) != 0 {
+		t.Errorf("got %d events without a baseline identity", len(events))
+	}
+
+	if tail.ident == (fileIdentity{}) {
+		t.Fatal("no identity was recorded")
+	}
+
+	if err := os.Chmod(pathname, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	events := tamperEvents(func() { checkAttrib(src, tail) })
+
+	if len(events) != 1 || events[0].Metadata["tamper"] != "permissions" {
+		t.Errorf("got %v, want a permissions change", events)
+	}
+
+}
@@ -0,0 +1,720 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/gdamore/tcell"
+	"gopkg.in/yaml.v2"
+)
+
+// TUI_MAX_EVENTS is how many events the dashboard holds on to.
+const TUI_MAX_EVENTS = 1000
+
+// severityLevels are the steps the dashboard's severity filter cycles
+// through, least severe first. "" shows everything.
+var severityLevels = []string{"", "info", "warning", "alert", "critical"}
+
+var severityStyles = map[string]tcell.Style{
+	"critical": tcell.StyleDefault.Foreground(tcell.ColorRed).Bold(true),
+	"alert":    tcell.StyleDefault.Foreground(tcell.ColorRed),
+	"warning":  tcell.StyleDefault.Foreground(tcell.ColorYellow),
+	"info":     tcell.StyleDefault.Foreground(tcell.ColorGreen),
+}
+
+var ansiEscape = regexp.MustCompile("\033\\[[0-9;]*m")
+
+// tuiEntry is a line in the dashboard's event list. Identical events in a
+// row share one entry.
+type tuiEntry struct {
+	ev     *logEvent
+	repeat int
+}
+
+// dashboard is the full-screen terminal view started with -tui. It gets its
+// events as a sink; everything else sublogmon prints is shown on its status
+// line instead of scrolling the terminal.
+type dashboard struct {
+	sync.Mutex
+	screen   tcell.Screen
+	stdout   *os.File
+	supfile  string
+	filters  []string
+	quit     chan os.Signal
+	closed   bool
+	events   []*tuiEntry
+	held     []*logEvent
+	paused   bool
+	selected *tuiEntry
+	minLevel int
+	idFilter string
+	typing   bool
+	input    string
+	message  string
+}
+
+// dash is the running dashboard, or nil when events go to the console.
+var dash *dashboard
+
+func newDashboard(supfile string) (*dashboard, error) {
+	screen, err := tcell.NewScreen()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = screen.Init(); err != nil {
+		return nil, err
+	}
+
+	r, w, err := os.Pipe()
+
+	if err != nil {
+		screen.Fini()
+		return nil, err
+	}
+
+	d := &dashboard{screen: screen, stdout: os.Stdout, supfile: supfile}
+	os.Stdout = w
+	log.SetOutput(w)
+
+	go d.readMessages(r)
+	go d.pollKeys()
+
+	go func() {
+
+		for range time.Tick(time.Second) {
+			d.redraw()
+		}
+
+	}()
+
+	d.redraw()
+	return d, nil
+}
+
+// setFilters tells the dashboard which filters to show counters for.
+func (d *dashboard) setFilters(sources []LogAuditFile) {
+	var ids []string
+
+	for i := 0; i < len(sources); i++ {
+
+		for j := 0; j < len(sources[i].Filters); j++ {
+
+			if id := sources[i].Filters[j].ID; len(id) > 0 {
+				ids = append(ids, id)
+			}
+
+		}
+
+	}
+
+	d.Lock()
+	d.filters = ids
+	d.Unlock()
+}
+
+// close gives the terminal back, so that the shutdown summary ends up on it.
+func (d *dashboard) close() {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.closed {
+		return
+	}
+
+	d.closed = true
+	d.screen.Fini()
+	os.Stdout = d.stdout
+	log.SetOutput(os.Stderr)
+}
+
+func (d *dashboard) Name() string {
+	return "dashboard"
+}
+
+func (d *dashboard) Send(ev *logEvent) error {
+	d.Lock()
+
+	if d.paused {
+		d.held = append(d.held, ev)
+	} else {
+		d.addEvent(ev)
+	}
+
+	d.Unlock()
+	d.redraw()
+	return nil
+}
+
+func (d *dashboard) addEvent(ev *logEvent) {
+
+	if n := len(d.events); n > 0 {
+		last := d.events[n-1]
+
+		if last.ev.EventID == ev.EventID && last.ev.Console == ev.Console {
+			last.ev = ev
+			last.repeat++
+			return
+		}
+
+	}
+
+	d.events = append(d.events, &tuiEntry{ev: ev})
+
+	if len(d.events) > TUI_MAX_EVENTS {
+		d.events = d.events[len(d.events)-TUI_MAX_EVENTS:]
+	}
+
+}
+
+// readMessages shows whatever else is printed on the status line.
+func (d *dashboard) readMessages(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		msg := strings.TrimSpace(ansiEscape.ReplaceAllString(scanner.Text(), ""))
+
+		if len(msg) == 0 {
+			continue
+		}
+
+		d.Lock()
+		d.message = msg
+		d.Unlock()
+		d.redraw()
+	}
+
+}
+
+func severityRank(severity string) int {
+
+	for i, level := range severityLevels {
+
+		if i > 0 && level == severity {
+			return i
+		}
+
+	}
+
+	return 0
+}
+
+// visible returns the events that pass the filters, newest first.
+func (d *dashboard) visible() []*tuiEntry {
+	var list []*tuiEntry
+
+	for i := len(d.events) - 1; i >= 0; i-- {
+		ev := d.events[i].ev
+
+		if d.minLevel > 0 && severityRank(ev.LogLevel) < d.minLevel {
+			continue
+		}
+
+		if len(d.idFilter) > 0 && !strings.Contains(ev.EventID, d.idFilter) {
+			continue
+		}
+
+		list = append(list, d.events[i])
+	}
+
+	return list
+}
+
+func (d *dashboard) pollKeys() {
+
+	for {
+		ev := d.screen.PollEvent()
+
+		if ev == nil {
+			return
+		}
+
+		switch kev := ev.(type) {
+		case *tcell.EventKey:
+			d.handleKey(kev)
+		case *tcell.EventResize:
+			d.screen.Sync()
+		}
+
+		d.redraw()
+	}
+
+}
+
+func (d *dashboard) handleKey(kev *tcell.EventKey) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.typing {
+
+		switch kev.Key() {
+		case tcell.KeyEnter:
+			d.idFilter = d.input
+			d.typing = false
+			d.selected = nil
+		case tcell.KeyEscape:
+			d.typing = false
+		case tcell.KeyBackspace, tcell.KeyBackspace2:
+
+			if len(d.input) > 0 {
+				d.input = d.input[:len(d.input)-1]
+			}
+
+		case tcell.KeyRune:
+			d.input += string(kev.Rune())
+		}
+
+		return
+	}
+
+	d.message = ""
+
+	switch kev.Key() {
+	case tcell.KeyCtrlC:
+		d.requestQuit()
+	case tcell.KeyUp:
+		d.moveSelection(-1)
+	case tcell.KeyDown:
+		d.moveSelection(1)
+	case tcell.KeyHome:
+		d.selected = nil
+	case tcell.KeyRune:
+
+		switch kev.Rune() {
+		case 'q':
+			d.requestQuit()
+		case 'p', ' ':
+			d.paused = !d.paused
+
+			if !d.paused {
+
+				for _, ev := range d.held {
+					d.addEvent(ev)
+				}
+
+				d.held = nil
+			}
+
+		case 's':
+			d.minLevel = (d.minLevel + 1) % len(severityLevels)
+			d.selected = nil
+		case '/':
+			d.typing = true
+			d.input = d.idFilter
+		case 'c':
+			d.idFilter = ""
+			d.minLevel = 0
+			d.selected = nil
+		case 'x':
+			d.suppressSelected()
+		case 'k':
+			d.moveSelection(-1)
+		case 'j':
+			d.moveSelection(1)
+		}
+
+	}
+
+}
+
+func (d *dashboard) requestQuit() {
+
+	select {
+	case d.quit <- os.Interrupt:
+	default:
+	}
+
+}
+
+// moveSelection moves the selection up (towards newer events) or down. No
+// selection means following the newest event.
+func (d *dashboard) moveSelection(delta int) {
+	list := d.visible()
+
+	if len(list) == 0 {
+		return
+	}
+
+	pos := 0
+
+	for i, entry := range list {
+
+		if entry == d.selected {
+			pos = i
+			break
+		}
+
+	}
+
+	if d.selected == nil && delta > 0 {
+		delta = 0
+	}
+
+	pos += delta
+
+	if pos < 0 {
+		d.selected = nil
+		return
+	}
+
+	if pos >= len(list) {
+		pos = len(list) - 1
+	}
+
+	d.selected = list[pos]
+}
+
+// current returns the event shown in the detail pane.
+func (d *dashboard) current() *tuiEntry {
+
+	if d.selected != nil {
+		return d.selected
+	}
+
+	if list := d.visible(); len(list) > 0 {
+		return list[0]
+	}
+
+	return nil
+}
+
+// suppressSelected adds a suppression for the selected event's output to the
+// suppression file. Saving it makes sublogmon reload, which puts it in effect.
+func (d *dashboard) suppressSelected() {
+	entry := d.current()
+
+	if entry == nil {
+		return
+	}
+
+	if strings.HasPrefix(entry.ev.EventID, INTERNAL_EVENT_PREFIX) {
+		d.message = "Events raised by sublogmon itself cannot be suppressed."
+		return
+	}
+
+	if err := appendSuppression(d.supfile, suppressionFor(entry.ev)); err != nil {
+		d.message = fmt.Sprintf("Error adding suppression: %v", err)
+		return
+	}
+
+	d.message = fmt.Sprintf("Added a suppression for \"%s\" to %s", entry.ev.Output, d.supfile)
+}
+
+// suppressionFor is the suppression the dashboard adds for an event. Its
+// wildcard is anchored, so that only events with exactly this output are
+// dropped, rather than every output that contains it.
+func suppressionFor(ev *logEvent) map[string]interface{} {
+	return map[string]interface{}{
+		"description": "Added from the dashboard for " + ev.EventID,
+		"wildcard":    "^" + regexp.QuoteMeta(ev.Output) + "$",
+		"metadata":    map[string]string{},
+	}
+}
+
+// appendSuppression adds an entry to a suppression file, leaving the ones
+// already in it as they are. The format is picked by extension, as
+// readConfigFile does: a JSON file is rewritten with the entry added, while
+// YAML and TOML files have it appended as text so that their comments
+// survive. The result has to decode to one more suppression than before, or
+// the file is left alone.
+func appendSuppression(supfile string, sup map[string]interface{}) error {
+	var before, after []LogSuppression
+
+	data, err := ioutil.ReadFile(supfile)
+
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if len(data) > 0 {
+
+		if err = decodeConfig(supfile, data, "LogSuppression", "Suppressions", &before); err != nil {
+			return err
+		}
+
+	}
+
+	var entry []byte
+
+	switch filepath.Ext(supfile) {
+	case ".yaml", ".yml":
+		entry, err = yaml.Marshal([]map[string]interface{}{sup})
+	case ".toml":
+		var buf bytes.Buffer
+		err = toml.NewEncoder(&buf).Encode(map[string][]map[string]interface{}{"Suppressions": {sup}})
+		entry = buf.Bytes()
+	default:
+		var entries []json.RawMessage
+
+		if len(data) > 0 {
+
+			if err = json.Unmarshal(data, &entries); err != nil {
+				return err
+			}
+
+		}
+
+		var raw json.RawMessage
+
+		if raw, err = json.Marshal(sup); err != nil {
+			return err
+		}
+
+		data, err = json.MarshalIndent(append(entries, raw), "", "\t")
+
+		if err != nil {
+			return err
+		}
+
+		data = append(data, '\n')
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if entry != nil {
+
+		if len(data) > 0 && data[len(data)-1] != '\n' {
+			data = append(data, '\n')
+		}
+
+		data = append(data, entry...)
+	}
+
+	err = decodeConfig(supfile, data, "LogSuppression", "Suppressions", &after)
+
+	if err != nil || len(after) != len(before)+1 {
+		return fmt.Errorf("%s is laid out in a way a new entry cannot simply be appended to; add it by hand", supfile)
+	}
+
+	tmpfile := supfile + ".tmp"
+
+	if err = ioutil.WriteFile(tmpfile, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpfile, supfile)
+}
+
+func (d *dashboard) drawText(x, y, maxx int, style tcell.Style, text string) int {
+
+	for _, r := range text {
+
+		if x >= maxx {
+			break
+		}
+
+		if r == '\t' || r == '\n' {
+			r = ' '
+		}
+
+		d.screen.SetContent(x, y, r, nil, style)
+		x++
+	}
+
+	return x
+}
+
+// drawWrapped draws text over as many lines as it needs, returning the line
+// after it.
+func (d *dashboard) drawWrapped(x, y, maxx, maxy int, style tcell.Style, text string) int {
+	width := maxx - x
+
+	if width <= 0 {
+		return y
+	}
+
+	runes := []rune(text)
+
+	for len(runes) > 0 && y < maxy {
+		n := width
+
+		if n > len(runes) {
+			n = len(runes)
+		}
+
+		d.drawText(x, y, maxx, style, string(runes[:n]))
+		runes = runes[n:]
+		y++
+	}
+
+	return y
+}
+
+func (d *dashboard) redraw() {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.closed {
+		return
+	}
+
+	s := d.screen
+	s.Clear()
+	w, h := s.Size()
+
+	if w < 20 || h < 8 {
+		s.Show()
+		return
+	}
+
+	bold := tcell.StyleDefault.Bold(true)
+	inverse := tcell.StyleDefault.Reverse(true)
+
+	side := w / 3
+
+	if side > 40 {
+		side = 40
+	}
+
+	listw := w - side - 1
+	listEnd := 1 + (h-2)*3/5
+	list := d.visible()
+
+	// Title bar.
+	title := fmt.Sprintf(" sublogmon: %d events", len(d.events))
+
+	if d.paused {
+		title += fmt.Sprintf("  [PAUSED, %d new]", len(d.held))
+	}
+
+	if d.minLevel > 0 {
+		title += "  severity>=" + severityLevels[d.minLevel]
+	}
+
+	if len(d.idFilter) > 0 {
+		title += "  id~" + d.idFilter
+	}
+
+	for x := 0; x < w; x++ {
+		s.SetContent(x, 0, ' ', nil, inverse)
+	}
+
+	d.drawText(0, 0, w, inverse, title)
+
+	// Event list, newest first.
+	cur := d.current()
+
+	first := 0
+
+	for i, entry := range list {
+
+		if entry == d.selected && i >= listEnd-1 {
+			first = i - (listEnd - 2)
+		}
+
+	}
+
+	for i, y := first, 1; i < len(list) && y < listEnd; i, y = i+1, y+1 {
+		entry := list[i]
+		style, ok := severityStyles[entry.ev.LogLevel]
+
+		if !ok {
+			style = tcell.StyleDefault
+		}
+
+		if entry == cur && d.selected != nil {
+			style = style.Reverse(true)
+		}
+
+		line := time.Unix(0, entry.ev.Timestamp).Format("15:04:05") + " " + entry.ev.EventID + ": " + entry.ev.Console
+
+		if entry.repeat > 0 {
+			line += fmt.Sprintf(" (x%d)", entry.repeat+1)
+		}
+
+		d.drawText(0, y, listw, style, line)
+	}
+
+	// Detail pane.
+	for x := 0; x < listw; x++ {
+		s.SetContent(x, listEnd, tcell.RuneHLine, nil, tcell.StyleDefault)
+	}
+
+	if cur != nil {
+		y := listEnd + 1
+		y = d.drawWrapped(0, y, listw, h-1, bold, cur.ev.Console)
+		y = d.drawWrapped(0, y, listw, h-1, tcell.StyleDefault, fmt.Sprintf("%s  %s  %s", cur.ev.EventID, cur.ev.LogLevel, time.Unix(0, cur.ev.Timestamp).Format(time.RFC3339)))
+
+		if len(cur.ev.OrigLogLine) > 0 {
+			y = d.drawWrapped(0, y, listw, h-1, tcell.StyleDefault.Dim(true), cur.ev.OrigLogLine)
+		}
+
+		keys := make([]string, 0, len(cur.ev.Metadata))
+
+		for key := range cur.ev.Metadata {
+			keys = append(keys, key)
+		}
+
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			y = d.drawWrapped(0, y, listw, h-1, tcell.StyleDefault, key+": "+cur.ev.Metadata[key])
+		}
+
+	}
+
+	// Sources and filter counters.
+	for y := 1; y < h-1; y++ {
+		s.SetContent(listw, y, tcell.RuneVLine, nil, tcell.StyleDefault)
+	}
+
+	status, lines, matches := metrics.dashboardCounts()
+	y := d.drawWrapped(listw+2, 1, w, h-1, bold, "Sources")
+
+	for _, label := range sortedKeys(status) {
+		style := tcell.StyleDefault.Foreground(tcell.ColorGreen)
+
+		if status[label] == SOURCE_WAITING {
+			style = tcell.StyleDefault.Foreground(tcell.ColorYellow)
+		} else if status[label] != SOURCE_ACTIVE {
+			style = tcell.StyleDefault.Foreground(tcell.ColorRed)
+		}
+
+		y = d.drawWrapped(listw+2, y, w, h-1, style, fmt.Sprintf("%s: %s, %d lines", label, status[label], lines[label]))
+	}
+
+	y = d.drawWrapped(listw+2, y+1, w, h-1, bold, "Filters")
+
+	for _, id := range d.filters {
+		y = d.drawWrapped(listw+2, y, w, h-1, tcell.StyleDefault, fmt.Sprintf("%s: %d", id, matches[id]))
+	}
+
+	// Status line.
+	bottom := d.message
+
+	if d.typing {
+		bottom = "Filter by ID: " + d.input + "_"
+	} else if len(bottom) == 0 {
+		bottom = "q quit  p pause  s severity  / filter ID  c clear filters  x suppress selected  up/down select  home newest"
+	}
+
+	d.drawText(0, h-1, w, tcell.StyleDefault, bottom)
+	s.Show()
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAppendSuppression(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		comment string
+	}{
+		{"suppressions.json", `[ { "description": "old", "wildcard": "noise" } ]`, ""},
+		{"suppressions.yaml", "# kept\n- description: old\n  wildcard: noise\n", "# kept"},
+		{"suppressions.toml", "# kept\n[[Suppressions]]\ndescription = \"old\"\nwildcard = \"noise\"\n", "# kept"},
+		{"empty.yaml", "", ""},
+	}
+
+	sup := map[string]interface{}{
+		"description": "Added from the dashboard for test",
+		"wildcard":    `grsec msg: \[x\]: "quoted"`,
+		"metadata":    map[string]string{},
+	}
+
+	for _, test := range tests {
+		fname := filepath.Join(t.TempDir(), test.name)
+
+		if err := ioutil.WriteFile(fname, []byte(test.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := appendSuppression(fname, sup); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		var sups []LogSuppression
+
+		if err := readConfigFile(fname, "LogSuppression", "Suppressions", &sups); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if len(sups) == 0 || sups[len(sups)-1].Wildcard != sup["wildcard"] {
+			t.Errorf("%s: the new entry did not come out as written: %+v", test.name, sups)
+		}
+
+		if len(test.content) > 0 && len(sups) != 2 {
+			t.Errorf("%s: got %d entries, want 2", test.name, len(sups))
+		}
+
+		data, _ := ioutil.ReadFile(fname)
+
+		if !strings.Contains(string(data), test.comment) {
+			t.Errorf("%s: comment was lost:\n%s", test.name, data)
+		}
+
+	}
+
+}
+
+func TestAppendSuppressionRefusesFlowYAML(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "suppressions.yaml")
+	content := "[ { description: old, wildcard: noise } ]\n"
+
+	if err := ioutil.WriteFile(fname, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := appendSuppression(fname, map[string]interface{}{"description": "new", "wildcard": "x"}); err == nil {
+		t.Fatal("appending to a flow style YAML list did not fail")
+	}
+
+	if data, _ := ioutil.ReadFile(fname); string(data) != content {
+		t.Errorf("the file was changed:\n%s", data)
+	}
+
+}
+
+// Once the file has been reloaded, the suppression the dashboard adds for an
+// event drops that event, and only that one.
+func TestDashboardSuppressionTakesEffect(t *testing.T) {
+	dir := t.TempDir()
+	conffile := filepath.Join(dir, "sublogmon.json")
+	supfile := filepath.Join(dir, "suppressions.json")
+
+	if err := ioutil.WriteFile(conffile, []byte(fmt.Sprintf(continueConfig, "")), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	logs := loadTestConfig(t, fmt.Sprintf(continueConfig, ""))
+	events := runLines(&logs[0], "access denied open (ptrace)")
+
+	if len(events) != 1 {
+		t.Fatalf("got %d events, want 1", len(events))
+	}
+
+	if err := appendSuppression(supfile, suppressionFor(events[0])); err != nil {
+		t.Fatal(err)
+	}
+
+	logs, sups, err := loadConfig(conffile, "", supfile, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Suppressions = sups
+	defer func() { Suppressions = nil }()
+
+	events = runLines(&logs[0], "access denied open (ptrace)", "access denied openat")
+
+	if len(events) != 1 || events[0].Output != "first openat" {
+		t.Errorf("got events %v, want only the one for openat", eventIDs(events))
+	}
+
+}